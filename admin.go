@@ -6,9 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -21,7 +19,7 @@ import (
 func (m *Map) admin(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 
@@ -29,6 +27,7 @@ func (m *Map) admin(rw http.ResponseWriter, req *http.Request) {
 	prefix := ""
 	maps := []MapInfo{}
 	defaultHide := false
+	resample := m.getResample()
 	m.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("users"))
 		if b == nil {
@@ -60,21 +59,27 @@ func (m *Map) admin(rw http.ResponseWriter, req *http.Request) {
 		Users       []string
 		Prefix      string
 		DefaultHide bool
+		Resample    string
+		Resamples   []string
 		Maps        []MapInfo
+		Snapshots   []SnapshotSummary
 	}{
 		Page:        m.getPage(req),
 		Session:     s,
 		Users:       users,
 		Prefix:      prefix,
 		DefaultHide: defaultHide,
+		Resample:    resample,
+		Resamples:   resampleNames,
 		Maps:        maps,
+		Snapshots:   m.getSnapshots(),
 	})
 }
 
 func (m *Map) adminUser(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 
@@ -105,13 +110,18 @@ func (m *Map) adminUser(rw http.ResponseWriter, req *http.Request) {
 			users.Put([]byte(username), raw)
 			return nil
 		})
+		m.audit(req, s, "saveUser", 0, nil, map[string]string{
+			"user":     username,
+			"auths":    strings.Join(auths, ","),
+			"password": strconv.FormatBool(password != ""),
+		})
 		if username == s.Username {
 			s.Auths = auths
 		}
 		if tempAdmin {
 			m.deleteSession(s)
 		}
-		http.Redirect(rw, req, "/admin", 302)
+		m.redirect(rw, req, "/admin")
 		return
 	}
 
@@ -145,14 +155,17 @@ func (m *Map) adminUser(rw http.ResponseWriter, req *http.Request) {
 func (m *Map) wipe(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 	err := m.db.Update(func(tx *bbolt.Tx) error {
-		if tx.Bucket([]byte("grids")) != nil {
-			err := tx.DeleteBucket([]byte("grids"))
-			if err != nil {
-				return err
+		// Queued zoom jobs would rebuild zoom tiles of the wiped maps
+		for _, b := range []string{"grids", "gridcoords", "zoomqueue"} {
+			if tx.Bucket([]byte(b)) != nil {
+				err := tx.DeleteBucket([]byte(b))
+				if err != nil {
+					return err
+				}
 			}
 		}
 		if tx.Bucket([]byte("markers")) != nil {
@@ -162,7 +175,11 @@ func (m *Map) wipe(rw http.ResponseWriter, req *http.Request) {
 			}
 		}
 		if tx.Bucket([]byte("tiles")) != nil {
-			err := tx.DeleteBucket([]byte("tiles"))
+			err := releaseAllTiles(tx)
+			if err != nil {
+				return err
+			}
+			err = tx.DeleteBucket([]byte("tiles"))
 			if err != nil {
 				return err
 			}
@@ -176,18 +193,21 @@ func (m *Map) wipe(rw http.ResponseWriter, req *http.Request) {
 		return nil
 	})
 	if err != nil {
-		log.Println(err)
+		logger(req).Error("Error wiping data", "error", err)
 	}
+	m.audit(req, s, "wipe", 0, nil, nil)
+	m.historic.drop(-1, time.Time{})
+	m.cache.RemoveAll("")
 	/*for z := 0; z <= 5; z++ {
 		os.RemoveAll(fmt.Sprintf("%s/%d", m.gridStorage, z))
 	}*/
-	http.Redirect(rw, req, "/admin/", 302)
+	m.redirect(rw, req, "/admin/")
 }
 
 func (m *Map) setPrefix(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 	m.db.Update(func(tx *bbolt.Tx) error {
@@ -197,13 +217,13 @@ func (m *Map) setPrefix(rw http.ResponseWriter, req *http.Request) {
 		}
 		return b.Put([]byte("prefix"), []byte(req.FormValue("prefix")))
 	})
-	http.Redirect(rw, req, "/admin/", 302)
+	m.redirect(rw, req, "/admin/")
 }
 
 func (m *Map) setDefaultHide(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 	m.db.Update(func(tx *bbolt.Tx) error {
@@ -217,13 +237,13 @@ func (m *Map) setDefaultHide(rw http.ResponseWriter, req *http.Request) {
 			return b.Delete([]byte("defaultHide"))
 		}
 	})
-	http.Redirect(rw, req, "/admin/", 302)
+	m.redirect(rw, req, "/admin/")
 }
 
 func (m *Map) setTitle(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 	m.db.Update(func(tx *bbolt.Tx) error {
@@ -233,18 +253,13 @@ func (m *Map) setTitle(rw http.ResponseWriter, req *http.Request) {
 		}
 		return b.Put([]byte("title"), []byte(req.FormValue("title")))
 	})
-	http.Redirect(rw, req, "/admin/", 302)
-}
-
-type zoomproc struct {
-	c Coord
-	m int
+	m.redirect(rw, req, "/admin/")
 }
 
 func (m *Map) rebuildZooms(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 	needProcess := map[zoomproc]struct{}{}
@@ -261,38 +276,34 @@ func (m *Map) rebuildZooms(rw http.ResponseWriter, req *http.Request) {
 			grid := GridData{}
 			json.Unmarshal(v, &grid)
 			needProcess[zoomproc{grid.Coord.Parent(), grid.Map}] = struct{}{}
-			saveGrid[zoomproc{grid.Coord, grid.Map}] = grid.ID
+			if file := lastTileVersion(tx, grid.ID); file != "" {
+				saveGrid[zoomproc{grid.Coord, grid.Map}] = file
+			}
 			return nil
 		})
+		err := releaseAllTiles(tx)
+		if err != nil {
+			return err
+		}
 		tx.DeleteBucket([]byte("tiles"))
 		return nil
 	})
 
+	m.audit(req, s, "rebuildZooms", 0, nil, nil)
 	if noGrids {
 		return
 	}
-	for g, id := range saveGrid {
-		f := fmt.Sprintf("%s/grids/%s.png", m.gridStorage, id)
-		if _, err := os.Stat(f); err != nil {
-			continue
-		}
-		m.SaveTile(g.m, g.c, 0, fmt.Sprintf("grids/%s.png", id), time.Now().UnixNano())
-	}
-	for z := 1; z <= 5; z++ {
-		process := needProcess
-		needProcess = map[zoomproc]struct{}{}
-		for p := range process {
-			m.updateZoomLevel(p.m, p.c, z)
-			needProcess[zoomproc{p.c.Parent(), p.m}] = struct{}{}
-		}
+	for g, file := range saveGrid {
+		m.SaveTile(g.m, g.c, 0, file, time.Now().UnixNano())
 	}
-	http.Redirect(rw, req, "/admin/", 302)
+	m.updateZooms(needProcess)
+	m.redirect(rw, req, "/admin/")
 }
 
 func (m *Map) deleteUser(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 
@@ -317,16 +328,29 @@ func (m *Map) deleteUser(rw http.ResponseWriter, req *http.Request) {
 				return err
 			}
 		}
+		apiKeys, err := tx.CreateBucketIfNotExists([]byte("apikeys"))
+		if err != nil {
+			return err
+		}
+		for _, key := range u.APIKeys {
+			err = apiKeys.Delete([]byte(key))
+			if err != nil {
+				return err
+			}
+		}
 		err = users.Delete([]byte(username))
 		if err != nil {
 			return err
 		}
 		return nil
 	})
+	m.audit(req, s, "deleteUser", 0, nil, map[string]string{
+		"user": username,
+	})
 	if username == s.Username {
 		m.deleteSession(s)
 	}
-	http.Redirect(rw, req, "/admin", 302)
+	m.redirect(rw, req, "/admin")
 	return
 }
 
@@ -335,7 +359,7 @@ var errFound = errors.New("found tile")
 func (m *Map) wipeTile(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 	mraw := req.FormValue("map")
@@ -358,37 +382,45 @@ func (m *Map) wipeTile(rw http.ResponseWriter, req *http.Request) {
 		Y: y,
 	}
 
+	wiped := []string{}
 	m.db.Update(func(tx *bbolt.Tx) error {
 		grids := tx.Bucket([]byte("grids"))
 		if grids == nil {
 			return nil
 		}
-		ids := [][]byte{}
-		err := grids.ForEach(func(k, v []byte) error {
-			g := GridData{}
-			err := json.Unmarshal(v, &g)
-			if err != nil {
-				return err
-			}
-			if g.Coord == c && g.Map == mapid {
-				ids = append(ids, k)
-			}
-			return nil
-		})
+		snap := &Snapshot{
+			Time:   time.Now(),
+			User:   s.Username,
+			Action: "wipeTile",
+			Map:    mapid,
+		}
+		snap.Grids = gridsAt(tx, mapid, c)
+		if td := m.getTile(tx, mapid, c, 0); td != nil {
+			snap.Tiles = append(snap.Tiles, *td)
+		}
+		err := saveSnapshot(tx, snap)
 		if err != nil {
 			return err
 		}
-		for _, id := range ids {
-			grids.Delete(id)
+		for _, g := range snap.Grids {
+			grids.Delete([]byte(g.ID))
+			err = unindexGrid(tx, g)
+			if err != nil {
+				return err
+			}
+			wiped = append(wiped, g.ID)
 		}
 
 		return nil
 	})
+	m.audit(req, s, "wipeTile", mapid, wiped, map[string]string{
+		"x": xraw,
+		"y": yraw,
+	})
+	m.clearHistoricCache(mapid)
 
-	m.SaveTile(mapid, c, 0, "", -1)
-	for z := 1; z <= 5; z++ {
-		c = c.Parent()
-		m.updateZoomLevel(mapid, c, z)
+	if m.SaveTile(mapid, c, 0, "", -1) {
+		m.updateZoom(mapid, c)
 	}
 	rw.WriteHeader(200)
 }
@@ -396,7 +428,7 @@ func (m *Map) wipeTile(rw http.ResponseWriter, req *http.Request) {
 func (m *Map) setCoords(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 	mraw := req.FormValue("map")
@@ -439,6 +471,7 @@ func (m *Map) setCoords(rw http.ResponseWriter, req *http.Request) {
 		Y: tc.Y - fc.Y,
 	}
 	tds := []*TileData{}
+	moved := 0
 	m.db.Update(func(tx *bbolt.Tx) error {
 		grids := tx.Bucket([]byte("grids"))
 		if grids == nil {
@@ -453,6 +486,13 @@ func (m *Map) setCoords(rw http.ResponseWriter, req *http.Request) {
 			return nil
 		}
 		mapTiles := mapZooms.Bucket([]byte("0"))
+		snap := &Snapshot{
+			Time:         time.Now(),
+			User:         s.Username,
+			Action:       "setCoords",
+			Map:          mapid,
+			ReplaceTiles: true,
+		}
 		err := grids.ForEach(func(k, v []byte) error {
 			g := GridData{}
 			err := json.Unmarshal(v, &g)
@@ -460,10 +500,12 @@ func (m *Map) setCoords(rw http.ResponseWriter, req *http.Request) {
 				return err
 			}
 			if g.Map == mapid {
+				snap.Grids = append(snap.Grids, g)
 				g.Coord.X += diff.X
 				g.Coord.Y += diff.Y
 				raw, _ := json.Marshal(g)
 				grids.Put(k, raw)
+				moved++
 			}
 			return nil
 		})
@@ -476,6 +518,7 @@ func (m *Map) setCoords(rw http.ResponseWriter, req *http.Request) {
 			if err != nil {
 				return err
 			}
+			snap.Tiles = append(snap.Tiles, *td)
 			td.Coord.X += diff.X
 			td.Coord.Y += diff.Y
 			tds = append(tds, td)
@@ -484,25 +527,38 @@ func (m *Map) setCoords(rw http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			return err
 		}
+		err = saveSnapshot(tx, snap)
+		if err != nil {
+			return err
+		}
+		err = reindexGrids(tx)
+		if err != nil {
+			return err
+		}
+		err = releaseTiles(tx, mapZooms)
+		if err != nil {
+			return err
+		}
 		err = tiles.DeleteBucket([]byte(strconv.Itoa(mapid)))
 		if err != nil {
 			return err
 		}
 		return nil
 	})
+	m.audit(req, s, "setCoords", mapid, nil, map[string]string{
+		"fx":    fxraw,
+		"fy":    fyraw,
+		"tx":    txraw,
+		"ty":    tyraw,
+		"grids": strconv.Itoa(moved),
+	})
+	m.clearHistoricCache(mapid)
 	needProcess := map[zoomproc]struct{}{}
 	for _, td := range tds {
 		m.SaveTile(td.MapID, td.Coord, td.Zoom, td.File, time.Now().UnixNano())
 		needProcess[zoomproc{c: Coord{X: td.Coord.X, Y: td.Coord.Y}.Parent(), m: td.MapID}] = struct{}{}
 	}
-	for z := 1; z <= 5; z++ {
-		process := needProcess
-		needProcess = map[zoomproc]struct{}{}
-		for p := range process {
-			m.updateZoomLevel(p.m, p.c, z)
-			needProcess[zoomproc{p.c.Parent(), p.m}] = struct{}{}
-		}
-	}
+	m.updateZooms(needProcess)
 	rw.WriteHeader(200)
 }
 
@@ -518,7 +574,9 @@ func (m *Map) backup(rw http.ResponseWriter, req *http.Request) {
 	zw := zip.NewWriter(rw)
 	defer zw.Close()
 
-	err := m.db.Update(func(tx *bbolt.Tx) error {
+	files := []string{}
+	seen := map[string]struct{}{}
+	err := m.db.View(func(tx *bbolt.Tx) error {
 		w, err := zw.Create("grids.db")
 		if err != nil {
 			return err
@@ -532,35 +590,56 @@ func (m *Map) backup(rw http.ResponseWriter, req *http.Request) {
 		if tiles == nil {
 			return nil
 		}
-		zoom := tiles.Bucket([]byte("0"))
-		if zoom == nil {
-			return nil
-		}
-		return zoom.ForEach(func(k, v []byte) error {
-			td := TileData{}
-			json.Unmarshal(v, &td)
-			if td.File == "" {
+		return tiles.ForEach(func(mk, mv []byte) error {
+			mapb := tiles.Bucket(mk)
+			if mapb == nil {
 				return nil
 			}
-			f, err := os.Open(m.gridStorage + "/" + td.File)
-			if err != nil {
+			zoom := mapb.Bucket([]byte("0"))
+			if zoom == nil {
 				return nil
 			}
-			defer f.Close()
-			w, err := zw.Create(td.File)
-			if err != nil {
-				return err
-			}
-			_, err = io.Copy(w, f)
-			return err
+			return zoom.ForEach(func(k, v []byte) error {
+				td := TileData{}
+				json.Unmarshal(v, &td)
+				if _, ok := seen[td.File]; td.File != "" && !ok {
+					seen[td.File] = struct{}{}
+					files = append(files, td.File)
+				}
+				return nil
+			})
 		})
 	})
+	// The bolt tile store is already part of grids.db
+	if err == nil && m.cfg.TileStore != "bolt" {
+		err = m.zipTiles(zw, files, files)
+	}
 	if err != nil {
-		log.Println(err)
+		logger(req).Error("Error writing backup", "error", err)
 	}
 
 }
 
+// zipTiles copies images from the tile store into the zip, files[i] is
+// stored as names[i]. Missing images are skipped.
+func (m *Map) zipTiles(zw *zip.Writer, files, names []string) error {
+	for i, file := range files {
+		f, err := m.tiles.Open(file)
+		if err != nil {
+			continue
+		}
+		w, err := zw.Create(names[i])
+		if err == nil {
+			_, err = io.Copy(w, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type mapData struct {
 	Grids   map[string]string
 	Markers map[string][]Marker
@@ -578,8 +657,10 @@ func (m *Map) export(rw http.ResponseWriter, req *http.Request) {
 	zw := zip.NewWriter(rw)
 	defer zw.Close()
 
-	err := m.db.Update(func(tx *bbolt.Tx) error {
-		maps := map[int]mapData{}
+	files := []string{}
+	names := []string{}
+	maps := map[int]mapData{}
+	err := m.db.View(func(tx *bbolt.Tx) error {
 		gridMap := map[string]int{}
 
 		grids := tx.Bucket([]byte("grids"))
@@ -624,16 +705,8 @@ func (m *Map) export(rw http.ResponseWriter, req *http.Request) {
 			if err != nil {
 				return err
 			}
-			w, err := zw.Create(fmt.Sprintf("%d/%s.png", gd.Map, gd.ID))
-			if err != nil {
-				return err
-			}
-			f, err := os.Open(filepath.Join(m.gridStorage, td.File))
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			io.Copy(w, f)
+			files = append(files, td.File)
+			names = append(names, fmt.Sprintf("%d/%s.png", gd.Map, gd.ID))
 			return nil
 		})
 		if err != nil {
@@ -674,8 +747,11 @@ func (m *Map) export(rw http.ResponseWriter, req *http.Request) {
 		}
 		return nil
 	})
+	if err == nil {
+		err = m.zipTiles(zw, files, names)
+	}
 	if err != nil {
-		log.Println(err)
+		logger(req).Error("Error writing export", "error", err)
 	}
 
 }
@@ -683,10 +759,11 @@ func (m *Map) export(rw http.ResponseWriter, req *http.Request) {
 func (m *Map) hideMarker(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 
+	marker := Marker{}
 	err := m.db.Update(func(tx *bbolt.Tx) error {
 		mb, err := tx.CreateBucketIfNotExists([]byte("markers"))
 		if err != nil {
@@ -708,35 +785,49 @@ func (m *Map) hideMarker(rw http.ResponseWriter, req *http.Request) {
 		if raw == nil {
 			return fmt.Errorf("Could not find key %s", string(key))
 		}
-		m := Marker{}
-		json.Unmarshal(raw, &m)
-		m.Hidden = true
-		raw, _ = json.Marshal(m)
+		json.Unmarshal(raw, &marker)
+		marker.Hidden = true
+		raw, _ = json.Marshal(marker)
 		grid.Put(key, raw)
 		return nil
 	})
 	if err != nil {
-		log.Println(err)
+		logger(req).Error("Error hiding marker", "error", err)
+		return
 	}
-	return
+	m.audit(req, s, "hideMarker", 0, []string{marker.GridID}, map[string]string{
+		"id":   req.FormValue("id"),
+		"name": marker.Name,
+	})
 }
 
 func (m *Map) merge(rw http.ResponseWriter, req *http.Request) {
-	err := req.ParseMultipartForm(1024 * 1024 * 500)
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
+		m.redirect(rw, req, "/")
+		return
+	}
+	req.Body = http.MaxBytesReader(rw, req.Body, m.cfg.MaxImportSize)
+	err := req.ParseMultipartForm(m.cfg.MaxImportSize)
 	if err != nil {
-		log.Println(err)
+		logger(req).Error("Error parsing merge upload", "error", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(rw, "upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(rw, "internal error", http.StatusInternalServerError)
 		return
 	}
 	mergef, hdr, err := req.FormFile("merge")
 	if err != nil {
-		log.Println(err)
+		logger(req).Warn("Merge file missing", "error", err)
 		http.Error(rw, "request error", http.StatusBadRequest)
 		return
 	}
 	zr, err := zip.NewReader(mergef, hdr.Size)
 	if err != nil {
-		log.Println(err)
+		logger(req).Warn("Error reading merge zip", "error", err)
 		http.Error(rw, "request error", http.StatusBadRequest)
 		return
 	}
@@ -746,7 +837,32 @@ func (m *Map) merge(rw http.ResponseWriter, req *http.Request) {
 		x, y  int
 		f     string
 	}{}
-	newTiles := map[string]struct{}{}
+	newTiles := map[string]string{}
+	imported := map[string]string{}
+
+	// Images go to the tile store first, the grids they belong to are looked
+	// up below once the grid data is merged
+	for _, fhdr := range zr.File {
+		if !strings.HasSuffix(fhdr.Name, ".png") {
+			continue
+		}
+		r, err := fhdr.Open()
+		var file string
+		if err == nil {
+			var data []byte
+			data, err = io.ReadAll(r)
+			r.Close()
+			if err == nil {
+				file, err = m.putBlob(data)
+			}
+		}
+		if err != nil {
+			logger(req).Error("Error storing merged tile", "file", fhdr.Name, "error", err)
+			http.Error(rw, "internal error", http.StatusInternalServerError)
+			return
+		}
+		newTiles[strings.TrimSuffix(filepath.Base(fhdr.Name), ".png")] = file
+	}
 
 	err = m.db.Update(func(tx *bbolt.Tx) error {
 		grids, err := tx.CreateBucketIfNotExists([]byte("grids"))
@@ -950,33 +1066,19 @@ func (m *Map) merge(rw http.ResponseWriter, req *http.Request) {
 						continue
 					}
 					mapB.Delete([]byte(strconv.Itoa(mergeid)))
-					log.Println("Reporting merge", mergeid, mapid)
+					logger(req).Info("Reporting merge", "from", mergeid, "to", mapid)
 					m.reportMerge(mergeid, mapid, Coord{X: offset.X - merge.X, Y: offset.Y - merge.Y})
 				}
 
-			} else if strings.HasSuffix(fhdr.Name, ".png") {
-				os.MkdirAll(filepath.Join(m.gridStorage, "grids"), 0777)
-				f, err := os.Create(filepath.Join(m.gridStorage, "grids", filepath.Base(fhdr.Name)))
-				if err != nil {
-					return err
-				}
-				r, err := fhdr.Open()
-				if err != nil {
-					f.Close()
-					return err
-				}
-				io.Copy(f, r)
-				r.Close()
-				f.Close()
-				newTiles[strings.TrimSuffix(filepath.Base(fhdr.Name), ".png")] = struct{}{}
 			}
 		}
 
-		for gid := range newTiles {
+		for gid, file := range newTiles {
 			gridRaw := grids.Get([]byte(gid))
 			if gridRaw != nil {
 				gd := GridData{}
 				json.Unmarshal(gridRaw, &gd)
+				imported[gid] = file
 				ops = append(ops, struct {
 					mapid int
 					x     int
@@ -986,19 +1088,32 @@ func (m *Map) merge(rw http.ResponseWriter, req *http.Request) {
 					mapid: gd.Map,
 					x:     gd.Coord.X,
 					y:     gd.Coord.Y,
-					f:     filepath.Join("grids", gid+".png"),
+					f:     file,
 				})
 			}
 		}
-		return nil
+		return reindexGrids(tx)
 	})
 
 	if err != nil {
-		log.Println(err)
+		logger(req).Error("Error merging", "error", err)
 		http.Error(rw, "internal error", http.StatusInternalServerError)
 		return
 	}
+	// Imported grids can land on any map
+	m.historic.drop(-1, time.Time{})
 
+	for gid, file := range imported {
+		err = m.addTileVersion(gid, s.Username, file)
+		if err != nil {
+			logger(req).Error("Error recording tile version", "grid", gid, "error", err)
+		}
+	}
+	m.audit(req, s, "merge", 0, nil, map[string]string{
+		"file":  hdr.Filename,
+		"size":  strconv.FormatInt(hdr.Size, 10),
+		"tiles": strconv.Itoa(len(newTiles)),
+	})
 	for _, op := range ops {
 		m.SaveTile(op.mapid, Coord{X: op.x, Y: op.y}, 0, op.f, time.Now().UnixNano())
 	}
@@ -1008,7 +1123,7 @@ func (m *Map) merge(rw http.ResponseWriter, req *http.Request) {
 func (m *Map) adminICMap(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 
@@ -1047,7 +1162,7 @@ func (m *Map) adminICMap(rw http.ResponseWriter, req *http.Request) {
 func (m *Map) adminMap(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 
@@ -1085,7 +1200,7 @@ func (m *Map) adminMap(rw http.ResponseWriter, req *http.Request) {
 			return maps.Put([]byte(strconv.Itoa(mapid)), rawmap)
 		})
 
-		http.Redirect(rw, req, "/admin", 302)
+		m.redirect(rw, req, "/admin")
 		return
 	}
 	mi := MapInfo{}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+//go:embed templates public
+var embedded embed.FS
+
+// assets returns the templates, public and frontend file systems, read from
+// the configured directories in dev mode and from the binary otherwise. The
+// frontend is read from disk if none was embedded.
+func (c ServerConfig) assets() (templates, public, frontend fs.FS) {
+	if c.Dev {
+		return os.DirFS(c.TemplatesDir), os.DirFS(c.PublicDir), os.DirFS(c.FrontendDir)
+	}
+	templates, _ = fs.Sub(embedded, "templates")
+	public, _ = fs.Sub(embedded, "public")
+	frontend = embeddedFrontend()
+	if frontend == nil {
+		frontend = os.DirFS(c.FrontendDir)
+	}
+	return templates, public, frontend
+}
+
+// noCache stops browsers caching files served from disk in dev mode.
+func noCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "no-cache")
+		next.ServeHTTP(rw, req)
+	})
+}
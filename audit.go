@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+type AuditEntry struct {
+	ID           uint64            `json:"id"`
+	Time         time.Time         `json:"time"`
+	User         string            `json:"user"`
+	IP           string            `json:"ip"`
+	ForwardedFor string            `json:"forwardedFor,omitempty"`
+	Action       string            `json:"action"`
+	Params       map[string]string `json:"params,omitempty"`
+	Map          int               `json:"map,omitempty"`
+	Grids        []string          `json:"grids,omitempty"`
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// audit appends an entry to the audit log. Entries are keyed by a zero padded
+// sequence number so that cursor order matches insertion order.
+func (m *Map) audit(req *http.Request, s *Session, action string, mapid int, grids []string, params map[string]string) {
+	e := AuditEntry{
+		Time:         time.Now(),
+		IP:           remoteIP(req),
+		ForwardedFor: req.Header.Get("X-Forwarded-For"),
+		Action:       action,
+		Params:       params,
+		Map:          mapid,
+		Grids:        grids,
+	}
+	if s != nil {
+		e.User = s.Username
+	}
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("audit"))
+		if err != nil {
+			return err
+		}
+		e.ID, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(fmt.Sprintf("%020d", e.ID)), raw)
+	})
+	if err != nil {
+		logger(req).Error("Error writing audit log", "error", err)
+	}
+}
+
+type auditFilter struct {
+	User   string
+	Action string
+	Map    string
+	Limit  int
+}
+
+func (f auditFilter) match(e AuditEntry) bool {
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.Map != "" && strconv.Itoa(e.Map) != f.Map {
+		return false
+	}
+	return true
+}
+
+// getAudit returns matching entries, newest first.
+func (m *Map) getAudit(f auditFilter) []AuditEntry {
+	entries := []AuditEntry{}
+	m.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("audit"))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			e := AuditEntry{}
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				continue
+			}
+			if !f.match(e) {
+				continue
+			}
+			entries = append(entries, e)
+			if f.Limit > 0 && len(entries) >= f.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return entries
+}
+
+func (m *Map) adminAudit(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
+		m.redirect(rw, req, "/")
+		return
+	}
+
+	f := auditFilter{
+		User:   req.FormValue("user"),
+		Action: req.FormValue("action"),
+		Map:    req.FormValue("map"),
+	}
+	f.Limit, _ = strconv.Atoi(req.FormValue("limit"))
+
+	if req.FormValue("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Content-Disposition", "attachment; filename=\"audit.json\"")
+		json.NewEncoder(rw).Encode(m.getAudit(f))
+		return
+	}
+
+	if f.Limit <= 0 {
+		f.Limit = 200
+	}
+
+	m.ExecuteTemplate(rw, "admin/audit.tmpl", struct {
+		Page    Page
+		Session *Session
+		Filter  auditFilter
+		Entries []AuditEntry
+	}{
+		Page:    m.getPage(req),
+		Session: s,
+		Filter:  f,
+		Entries: m.getAudit(f),
+	})
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andyleap/hnh-map/tilestore"
+
+	"go.etcd.io/bbolt"
+)
+
+// Tile images are stored once per distinct content, as blobs/{hash}.png
+// named by their sha256. The blobs bucket counts the tiles, history versions
+// and snapshots using each image. Images nothing uses any more are listed in
+// the orphans bucket and removed by sweepBlobs once they have been unused for
+// blobGracePeriod, which covers operations that drop a tile and save it again.
+const (
+	blobGracePeriod   = time.Hour
+	blobSweepInterval = 10 * time.Minute
+)
+
+func blobFile(hash string) string {
+	return fmt.Sprintf("blobs/%s/%s.png", hash[:2], hash)
+}
+
+// blobHash returns the hash of a blob file, or "" for other files.
+func blobHash(file string) string {
+	if !strings.HasPrefix(file, "blobs/") {
+		return ""
+	}
+	return strings.TrimSuffix(path.Base(file), ".png")
+}
+
+// putBlob stores an image and returns its file. Nothing is written if the
+// same image is already stored. A new image starts out unused, so it is swept
+// like any other orphan if the caller never ends up using it.
+func (m *Map) putBlob(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	m.blobmu.Lock()
+	defer m.blobmu.Unlock()
+	stored, orphaned := false, false
+	m.db.View(func(tx *bbolt.Tx) error {
+		if blobs := tx.Bucket([]byte("blobs")); blobs != nil {
+			stored = blobs.Get([]byte(hash)) != nil
+		}
+		if orphans := tx.Bucket([]byte("orphans")); orphans != nil {
+			orphaned = orphans.Get([]byte(hash)) != nil
+		}
+		return nil
+	})
+	if orphaned {
+		// Give the caller time to use it before it is swept
+		err := m.db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte("orphans")).Put([]byte(hash), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if stored {
+		return blobFile(hash), nil
+	}
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		blobs, err := tx.CreateBucketIfNotExists([]byte("blobs"))
+		if err != nil {
+			return err
+		}
+		err = blobs.Put([]byte(hash), []byte("0"))
+		if err != nil {
+			return err
+		}
+		orphans, err := tx.CreateBucketIfNotExists([]byte("orphans"))
+		if err != nil {
+			return err
+		}
+		return orphans.Put([]byte(hash), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	})
+	if err != nil {
+		return "", err
+	}
+	return blobFile(hash), m.tiles.Put(blobFile(hash), bytes.NewReader(data))
+}
+
+func retainBlob(tx *bbolt.Tx, file string) error {
+	hash := blobHash(file)
+	if hash == "" {
+		return nil
+	}
+	blobs, err := tx.CreateBucketIfNotExists([]byte("blobs"))
+	if err != nil {
+		return err
+	}
+	n, _ := strconv.Atoi(string(blobs.Get([]byte(hash))))
+	if n == 0 {
+		if orphans := tx.Bucket([]byte("orphans")); orphans != nil {
+			err = orphans.Delete([]byte(hash))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return blobs.Put([]byte(hash), []byte(strconv.Itoa(n+1)))
+}
+
+func releaseBlob(tx *bbolt.Tx, file string) error {
+	hash := blobHash(file)
+	if hash == "" {
+		return nil
+	}
+	blobs := tx.Bucket([]byte("blobs"))
+	if blobs == nil {
+		return nil
+	}
+	raw := blobs.Get([]byte(hash))
+	if raw == nil {
+		return nil
+	}
+	n, _ := strconv.Atoi(string(raw))
+	if n > 1 {
+		return blobs.Put([]byte(hash), []byte(strconv.Itoa(n-1)))
+	}
+	err := blobs.Put([]byte(hash), []byte("0"))
+	if err != nil {
+		return err
+	}
+	orphans, err := tx.CreateBucketIfNotExists([]byte("orphans"))
+	if err != nil {
+		return err
+	}
+	return orphans.Put([]byte(hash), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+}
+
+// releaseTiles releases the images of every tile of a map, before its
+// bucket is deleted.
+func releaseTiles(tx *bbolt.Tx, mapb *bbolt.Bucket) error {
+	return mapb.ForEach(func(k, v []byte) error {
+		zoom := mapb.Bucket(k)
+		if zoom == nil {
+			return nil
+		}
+		return zoom.ForEach(func(tk, tv []byte) error {
+			td := TileData{}
+			json.Unmarshal(tv, &td)
+			return releaseBlob(tx, td.File)
+		})
+	})
+}
+
+func releaseAllTiles(tx *bbolt.Tx) error {
+	tiles := tx.Bucket([]byte("tiles"))
+	if tiles == nil {
+		return nil
+	}
+	return tiles.ForEach(func(k, v []byte) error {
+		mapb := tiles.Bucket(k)
+		if mapb == nil {
+			return nil
+		}
+		return releaseTiles(tx, mapb)
+	})
+}
+
+func (m *Map) sweepBlobs(ctx context.Context) {
+	t := time.NewTicker(blobSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		err := m.removeOrphans()
+		if err != nil {
+			slog.Error("Error removing unused tiles", "error", err)
+		}
+	}
+}
+
+// removeOrphans removes the images that have been unused for longer than
+// blobGracePeriod.
+func (m *Map) removeOrphans() error {
+	m.blobmu.Lock()
+	defer m.blobmu.Unlock()
+	cutoff := time.Now().Add(-blobGracePeriod).Unix()
+	stale := []string{}
+	m.db.View(func(tx *bbolt.Tx) error {
+		orphans := tx.Bucket([]byte("orphans"))
+		if orphans == nil {
+			return nil
+		}
+		return orphans.ForEach(func(k, v []byte) error {
+			t, _ := strconv.ParseInt(string(v), 10, 64)
+			if t < cutoff {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+	})
+	if len(stale) == 0 {
+		return nil
+	}
+
+	removed := []string{}
+	for _, hash := range stale {
+		err := m.tiles.Remove(blobFile(hash))
+		if err != nil && !errors.Is(err, tilestore.ErrNotExist) {
+			slog.Warn("Error removing unused tile", "hash", hash, "error", err)
+			continue
+		}
+		removed = append(removed, hash)
+		m.cache.Remove(webpFile(hash))
+	}
+	slog.Debug("Removed unused tiles", "count", len(removed))
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		blobs := tx.Bucket([]byte("blobs"))
+		orphans := tx.Bucket([]byte("orphans"))
+		for _, hash := range removed {
+			if string(blobs.Get([]byte(hash))) == "0" {
+				err := blobs.Delete([]byte(hash))
+				if err != nil {
+					return err
+				}
+			}
+			err := orphans.Delete([]byte(hash))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// tileRef is a stored record using tile images: a tile, a history version or
+// a snapshot. files point into v.
+type tileRef struct {
+	b     *bbolt.Bucket
+	k     []byte
+	v     interface{}
+	files []*string
+}
+
+func tileRefs(tx *bbolt.Tx) []tileRef {
+	refs := []tileRef{}
+	if tiles := tx.Bucket([]byte("tiles")); tiles != nil {
+		tiles.ForEach(func(mk, _ []byte) error {
+			mapb := tiles.Bucket(mk)
+			if mapb == nil {
+				return nil
+			}
+			return mapb.ForEach(func(zk, _ []byte) error {
+				zoom := mapb.Bucket(zk)
+				if zoom == nil {
+					return nil
+				}
+				return zoom.ForEach(func(k, v []byte) error {
+					td := &TileData{}
+					json.Unmarshal(v, td)
+					refs = append(refs, tileRef{zoom, append([]byte{}, k...), td, []*string{&td.File}})
+					return nil
+				})
+			})
+		})
+	}
+	if history := tx.Bucket([]byte("history")); history != nil {
+		history.ForEach(func(gk, _ []byte) error {
+			b := history.Bucket(gk)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				tv := &TileVersion{}
+				json.Unmarshal(v, tv)
+				refs = append(refs, tileRef{b, append([]byte{}, k...), tv, []*string{&tv.File}})
+				return nil
+			})
+		})
+	}
+	if snapshots := tx.Bucket([]byte("snapshots")); snapshots != nil {
+		snapshots.ForEach(func(k, v []byte) error {
+			s := &Snapshot{}
+			json.Unmarshal(v, s)
+			files := []*string{}
+			for i := range s.Tiles {
+				files = append(files, &s.Tiles[i].File)
+			}
+			refs = append(refs, tileRef{snapshots, append([]byte{}, k...), s, files})
+			return nil
+		})
+	}
+	return refs
+}
+
+// migrateBlobs moves images written before tiles were content addressed into
+// blobs. It runs once, at startup.
+func (m *Map) migrateBlobs() error {
+	done := false
+	files := map[string]string{}
+	m.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte("config")).Get([]byte("blobs")) != nil {
+			done = true
+			return nil
+		}
+		for _, ref := range tileRefs(tx) {
+			for _, f := range ref.files {
+				if *f != "" && blobHash(*f) == "" {
+					files[*f] = ""
+				}
+			}
+		}
+		return nil
+	})
+	if done {
+		return nil
+	}
+
+	slog.Info("Moving tile images to content addressed storage", "files", len(files))
+	modTimes := map[string]time.Time{}
+	// Every new blob is recorded as it is stored, sync once after them
+	m.db.NoSync = true
+	defer func() {
+		m.db.NoSync = false
+	}()
+	for file := range files {
+		f, err := m.tiles.Open(file)
+		if err != nil {
+			slog.Warn("Missing tile image", "file", file, "error", err)
+			continue
+		}
+		data, err := io.ReadAll(f)
+		modTimes[file] = f.ModTime()
+		f.Close()
+		if err != nil {
+			return err
+		}
+		files[file], err = m.putBlob(data)
+		if err != nil {
+			return err
+		}
+	}
+	m.db.NoSync = false
+	err := m.db.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = m.db.Update(func(tx *bbolt.Tx) error {
+		for _, ref := range tileRefs(tx) {
+			changed := false
+			for _, f := range ref.files {
+				if blob := files[*f]; blob != "" {
+					*f = blob
+					changed = true
+					err := retainBlob(tx, blob)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if !changed {
+				continue
+			}
+			raw, err := json.Marshal(ref.v)
+			if err != nil {
+				return err
+			}
+			err = ref.b.Put(ref.k, raw)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Grids uploaded before history was kept get their image as the
+		// first version, dated by the file
+		grids := tx.Bucket([]byte("grids"))
+		if grids == nil {
+			return tx.Bucket([]byte("config")).Put([]byte("blobs"), []byte("1"))
+		}
+		history, err := tx.CreateBucketIfNotExists([]byte("history"))
+		if err != nil {
+			return err
+		}
+		gds := []GridData{}
+		grids.ForEach(func(k, v []byte) error {
+			gd := GridData{}
+			json.Unmarshal(v, &gd)
+			gds = append(gds, gd)
+			return nil
+		})
+		for _, gd := range gds {
+			if b := history.Bucket([]byte(gd.ID)); b != nil {
+				if k, _ := b.Cursor().First(); k != nil {
+					continue
+				}
+			}
+			blob := files[gridFile(gd.ID)]
+			td := m.getTile(tx, gd.Map, gd.Coord, 0)
+			if blob == "" || td == nil || td.File != blob {
+				continue
+			}
+			b, err := history.CreateBucketIfNotExists([]byte(gd.ID))
+			if err != nil {
+				return err
+			}
+			tv := TileVersion{
+				Time: modTimes[gridFile(gd.ID)],
+				File: blob,
+			}
+			tv.ID, err = b.NextSequence()
+			if err != nil {
+				return err
+			}
+			raw, err := json.Marshal(tv)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(fmt.Sprintf("%020d", tv.ID)), raw)
+			if err != nil {
+				return err
+			}
+			err = retainBlob(tx, blob)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte("config")).Put([]byte("blobs"), []byte("1"))
+	})
+	if err != nil {
+		return err
+	}
+
+	for file, blob := range files {
+		if blob != "" {
+			m.tiles.Remove(file)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/andyleap/hnh-map/tilestore"
+	"go.etcd.io/bbolt"
+)
+
+func TestUnusedBlobsAreSwept(t *testing.T) {
+	dir := t.TempDir()
+	db, err := bbolt.Open(filepath.Join(dir, "grids.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := &Map{
+		db:    db,
+		tiles: tilestore.NewFS(dir),
+		cache: tilestore.NewFS(filepath.Join(dir, "historycache")),
+	}
+
+	unused, err := m.putBlob([]byte("never used"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := m.putBlob([]byte("used by a tile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		err := retainBlob(tx, used)
+		if err != nil {
+			return err
+		}
+		// Past the grace period
+		old := []byte(strconv.FormatInt(time.Now().Add(-2*blobGracePeriod).Unix(), 10))
+		return tx.Bucket([]byte("orphans")).Put([]byte(blobHash(unused)), old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.removeOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.tiles.Open(unused)
+	if !errors.Is(err, tilestore.ErrNotExist) {
+		t.Errorf("unused blob not removed: %v", err)
+	}
+	f, err := m.tiles.Open(used)
+	if err != nil {
+		t.Fatalf("used blob removed: %v", err)
+	}
+	f.Close()
+	db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket([]byte("blobs")).Get([]byte(blobHash(unused))); v != nil {
+			t.Errorf("removed blob still counted as %q", v)
+		}
+		if v := string(tx.Bucket([]byte("blobs")).Get([]byte(blobHash(used)))); v != "1" {
+			t.Errorf("used blob counted %q, want 1", v)
+		}
+		return nil
+	})
+}
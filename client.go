@@ -3,15 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
-	"image/png"
-	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -26,6 +23,27 @@ var clientPath = regexp.MustCompile("client/([^/]+)/(.*)")
 
 var UserInfo struct{}
 
+func requestUser(req *http.Request) string {
+	user, _ := req.Context().Value(UserInfo).(string)
+	return user
+}
+
+type tokenKey struct{}
+
+// tokenLabel shortens a token so logs can tell tokens apart without
+// leaking them.
+func tokenLabel(token string) string {
+	if len(token) > 6 {
+		return token[:6]
+	}
+	return token
+}
+
+func requestToken(req *http.Request) string {
+	token, _ := req.Context().Value(tokenKey{}).(string)
+	return token
+}
+
 const VERSION = "4"
 
 func (m *Map) client(rw http.ResponseWriter, req *http.Request) {
@@ -67,7 +85,9 @@ func (m *Map) client(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	ctx := context.WithValue(req.Context(), UserInfo, user)
+	ctx = context.WithValue(ctx, tokenKey{}, matches[1])
 	req = req.WithContext(ctx)
+	req = withLogger(req, "user", user, "token", tokenLabel(matches[1]), "action", matches[2])
 
 	switch matches[2] {
 	case "locate":
@@ -83,7 +103,7 @@ func (m *Map) client(rw http.ResponseWriter, req *http.Request) {
 	/*case "mapData":
 	m.mapdataIndex(rw, req)*/
 	case "":
-		http.Redirect(rw, req, "/map/", 302)
+		m.redirect(rw, req, "/map/")
 	case "checkVersion":
 		if req.FormValue("version") == VERSION {
 			rw.WriteHeader(200)
@@ -107,15 +127,15 @@ func (m *Map) updatePositions(rw http.ResponseWriter, req *http.Request) {
 	}{}
 	buf, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Println("Error reading position update json: ", err)
+		logger(req).Warn("Error reading position update json", "error", err)
 		return
 	}
 	err = json.Unmarshal(buf, &craws)
 	if err != nil {
-		log.Println("Error decoding position update json: ", err)
-		log.Println("Original json: ", string(buf))
+		logger(req).Warn("Error decoding position update json", "error", err, "json", string(buf))
 		return
 	}
+	deltas := map[int]UploadStats{}
 	m.db.View(func(tx *bbolt.Tx) error {
 		grids := tx.Bucket([]byte("grids"))
 		if grids == nil {
@@ -130,6 +150,9 @@ func (m *Map) updatePositions(rw http.ResponseWriter, req *http.Request) {
 			}
 			gd := GridData{}
 			json.Unmarshal(grid, &gd)
+			d := deltas[gd.Map]
+			d.Positions++
+			deltas[gd.Map] = d
 			idnum, _ := strconv.Atoi(id)
 			c := Character{
 				Name: craw.Name,
@@ -167,7 +190,7 @@ func (m *Map) updatePositions(rw http.ResponseWriter, req *http.Request) {
 		}
 		return nil
 	})
-
+	m.addStats(req, deltas)
 }
 
 func (m *Map) uploadMarkers(rw http.ResponseWriter, req *http.Request) {
@@ -182,15 +205,15 @@ func (m *Map) uploadMarkers(rw http.ResponseWriter, req *http.Request) {
 	}{}
 	buf, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Println("Error reading marker json: ", err)
+		logger(req).Warn("Error reading marker json", "error", err)
 		return
 	}
 	err = json.Unmarshal(buf, &markers)
 	if err != nil {
-		log.Println("Error decoding marker json: ", err)
-		log.Println("Original json: ", string(buf))
+		logger(req).Warn("Error decoding marker json", "error", err, "json", string(buf))
 		return
 	}
+	deltas := map[int]UploadStats{}
 	err = m.db.Update(func(tx *bbolt.Tx) error {
 		mb, err := tx.CreateBucketIfNotExists([]byte("markers"))
 		if err != nil {
@@ -204,6 +227,10 @@ func (m *Map) uploadMarkers(rw http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			return err
 		}
+		grids, err := tx.CreateBucketIfNotExists([]byte("grids"))
+		if err != nil {
+			return err
+		}
 
 		for _, mraw := range markers {
 			key := []byte(fmt.Sprintf("%s_%d_%d", mraw.GridID, mraw.X, mraw.Y))
@@ -231,13 +258,22 @@ func (m *Map) uploadMarkers(rw http.ResponseWriter, req *http.Request) {
 			raw, _ := json.Marshal(m)
 			grid.Put(key, raw)
 			idB.Put(idKey, key)
+
+			gd := GridData{}
+			if graw := grids.Get([]byte(mraw.GridID)); graw != nil {
+				json.Unmarshal(graw, &gd)
+			}
+			d := deltas[gd.Map]
+			d.Markers++
+			deltas[gd.Map] = d
 		}
 		return nil
 	})
 	if err != nil {
-		log.Println("Error update db: ", err)
+		logger(req).Error("Error updating markers", "error", err)
 		return
 	}
+	m.addStats(req, deltas)
 }
 
 func (m *Map) locate(rw http.ResponseWriter, req *http.Request) {
@@ -274,17 +310,23 @@ type GridRequest struct {
 	Coords       Coord    `json:"coords"`
 }
 
+const lastSeenResolution = time.Minute
+
 func (m *Map) gridUpdate(rw http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	dec := json.NewDecoder(req.Body)
 	grup := GridUpdate{}
 	err := dec.Decode(&grup)
 	if err != nil {
-		log.Println("Error decoding grid request json: ", err)
+		logger(req).Warn("Error decoding grid request json", "error", err)
 		http.Error(rw, "Error decoding request", http.StatusBadRequest)
 		return
 	}
-	log.Println(grup)
+	logger(req).Debug("Grid update", "grids", grup.Grids)
+
+	user := requestUser(req)
+	now := time.Now()
+	deltas := map[int]UploadStats{}
 
 	ops := []struct {
 		mapid int
@@ -341,7 +383,7 @@ func (m *Map) gridUpdate(rw http.ResponseWriter, req *http.Request) {
 			if err != nil {
 				return err
 			}
-			log.Println("Client made mapid ", seq)
+			logger(req).Info("Client made map", "map", seq)
 			for x, row := range grup.Grids {
 				for y, grid := range row {
 
@@ -350,12 +392,22 @@ func (m *Map) gridUpdate(rw http.ResponseWriter, req *http.Request) {
 					cur.Map = int(seq)
 					cur.Coord.X = x - 1
 					cur.Coord.Y = y - 1
+					cur.Creator = user
+					cur.FirstSeen = now
+					cur.LastSeen = now
+					d := deltas[cur.Map]
+					d.Grids++
+					deltas[cur.Map] = d
 
 					raw, err := json.Marshal(cur)
 					if err != nil {
 						return err
 					}
 					grids.Put([]byte(grid), raw)
+					err = indexGrid(tx, cur)
+					if err != nil {
+						return err
+					}
 					greq.GridRequests = append(greq.GridRequests, grid)
 				}
 			}
@@ -382,7 +434,8 @@ func (m *Map) gridUpdate(rw http.ResponseWriter, req *http.Request) {
 			}
 		}
 
-		log.Println("Client in mapid ", mapid)
+		req = withLogger(req, "map", mapid)
+		logger(req).Debug("Client in map")
 
 		for x, row := range grup.Grids {
 			for y, grid := range row {
@@ -392,6 +445,17 @@ func (m *Map) gridUpdate(rw http.ResponseWriter, req *http.Request) {
 					if time.Now().After(cur.NextUpdate) {
 						greq.GridRequests = append(greq.GridRequests, grid)
 					}
+					// Clients report the grids around them every few
+					// seconds, so LastSeen is only kept to the minute
+					if now.Sub(cur.LastSeen) < lastSeenResolution {
+						continue
+					}
+					cur.LastSeen = now
+					raw, err := json.Marshal(cur)
+					if err != nil {
+						return err
+					}
+					grids.Put([]byte(grid), raw)
 					continue
 				}
 
@@ -399,11 +463,21 @@ func (m *Map) gridUpdate(rw http.ResponseWriter, req *http.Request) {
 				cur.Map = mapid
 				cur.Coord.X = x + offset.X
 				cur.Coord.Y = y + offset.Y
+				cur.Creator = user
+				cur.FirstSeen = now
+				cur.LastSeen = now
+				d := deltas[cur.Map]
+				d.Grids++
+				deltas[cur.Map] = d
 				raw, err := json.Marshal(cur)
 				if err != nil {
 					return err
 				}
 				grids.Put([]byte(grid), raw)
+				err = indexGrid(tx, cur)
+				if err != nil {
+					return err
+				}
 				greq.GridRequests = append(greq.GridRequests, grid)
 			}
 		}
@@ -456,35 +530,33 @@ func (m *Map) gridUpdate(rw http.ResponseWriter, req *http.Request) {
 				}
 				return nil
 			})
+			err = reindexGrids(tx)
+			if err != nil {
+				return err
+			}
 		}
 		for mergeid, merge := range maps {
 			if mapid == mergeid {
 				continue
 			}
 			mapB.Delete([]byte(strconv.Itoa(mergeid)))
-			log.Println("Reporting merge", mergeid, mapid)
+			logger(req).Info("Reporting merge", "from", mergeid, "to", mapid)
 			m.reportMerge(mergeid, mapid, Coord{X: offset.X - merge.X, Y: offset.Y - merge.Y})
 		}
 		return nil
 	})
 	if err != nil {
-		log.Println(err)
+		logger(req).Error("Error updating grids", "error", err)
 		return
 	}
+	m.addStats(req, deltas)
 	needProcess := map[zoomproc]struct{}{}
 	for _, op := range ops {
 		m.SaveTile(op.mapid, Coord{X: op.x, Y: op.y}, 0, op.f, time.Now().UnixNano())
 		needProcess[zoomproc{c: Coord{X: op.x, Y: op.y}.Parent(), m: op.mapid}] = struct{}{}
 	}
-	for z := 1; z <= 5; z++ {
-		process := needProcess
-		needProcess = map[zoomproc]struct{}{}
-		for p := range process {
-			m.updateZoomLevel(p.m, p.c, z)
-			needProcess[zoomproc{p.c.Parent(), p.m}] = struct{}{}
-		}
-	}
-	log.Println(greq)
+	m.updateZooms(needProcess)
+	logger(req).Debug("Grid request", "map", greq.Map, "coords", greq.Coords, "requests", len(greq.GridRequests))
 	json.NewEncoder(rw).Encode(greq)
 }
 
@@ -521,13 +593,19 @@ func (m *Map) gridUpload(rw http.ResponseWriter, req *http.Request) {
 		req.Header.Set("Content-Type", parts[0]+"=\""+parts[1]+"\"")
 	}
 
-	err := req.ParseMultipartForm(100000000)
+	req.Body = http.MaxBytesReader(rw, req.Body, m.cfg.MaxUploadSize)
+	err := req.ParseMultipartForm(m.cfg.MaxUploadSize)
 	if err != nil {
-		log.Println(err)
+		logger(req).Warn("Error parsing tile upload", "error", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(rw, "upload too large", http.StatusRequestEntityTooLarge)
+		}
 		return
 	}
 
 	id := req.FormValue("id")
+	req = withLogger(req, "grid", id)
 
 	extraData := req.FormValue("extraData")
 	if extraData != "" {
@@ -579,7 +657,7 @@ func (m *Map) gridUpload(rw http.ResponseWriter, req *http.Request) {
 				}
 
 				if time.Now().After(cur.NextUpdate) {
-					cur.NextUpdate = time.Now().Add(time.Minute * 30)
+					cur.NextUpdate = time.Now().Add(m.cfg.NextUpdate.Duration)
 				}
 
 				raw, err := json.Marshal(cur)
@@ -591,21 +669,22 @@ func (m *Map) gridUpload(rw http.ResponseWriter, req *http.Request) {
 				return nil
 			})
 			if !needTile {
-				log.Println("ignoring tile upload: winter")
+				logger(req).Debug("Ignoring tile upload: winter")
+				tileUploads.WithLabelValues("winter").Inc()
 				return
 			} else {
-				log.Println("Missing tile, using winter version")
+				logger(req).Debug("Missing tile, using winter version")
 			}
 		}
 	}
 
 	file, _, err := req.FormFile("file")
 	if err != nil {
-		log.Println(err)
+		logger(req).Warn("Tile upload missing file", "error", err)
 		return
 	}
 
-	log.Println("map tile for ", id)
+	logger(req).Debug("Map tile upload")
 
 	updateTile := false
 	cur := GridData{}
@@ -630,7 +709,9 @@ func (m *Map) gridUpload(rw http.ResponseWriter, req *http.Request) {
 		mapid = cur.Map
 
 		if updateTile {
-			cur.NextUpdate = time.Now().Add(time.Minute * 30)
+			cur.NextUpdate = time.Now().Add(m.cfg.NextUpdate.Duration)
+			cur.Uploader = requestUser(req)
+			cur.LastUpload = time.Now()
 		}
 
 		raw, err := json.Marshal(cur)
@@ -642,32 +723,49 @@ func (m *Map) gridUpload(rw http.ResponseWriter, req *http.Request) {
 		return nil
 	})
 
+	if !updateTile {
+		tileUploads.WithLabelValues("nextupdate").Inc()
+	}
+
 	if updateTile {
-		os.MkdirAll(fmt.Sprintf("%s/grids", m.gridStorage), 0600)
-		f, err := os.Create(fmt.Sprintf("%s/grids/%s.png", m.gridStorage, cur.ID))
+		data, err := ioutil.ReadAll(file)
 		if err != nil {
+			logger(req).Warn("Error reading tile upload", "error", err)
 			return
 		}
-		_, err = io.Copy(f, file)
+		f, err := m.putBlob(data)
 		if err != nil {
-			f.Close()
+			logger(req).Error("Error writing tile", "error", err)
 			return
 		}
-		f.Close()
+		m.addStats(req, map[int]UploadStats{mapid: {Tiles: 1}})
 
-		m.SaveTile(mapid, cur.Coord, 0, fmt.Sprintf("grids/%s.png", cur.ID), time.Now().UnixNano())
+		if !m.SaveTile(mapid, cur.Coord, 0, f, time.Now().UnixNano()) {
+			logger(req).Debug("Tile unchanged")
+			tileUploads.WithLabelValues("unchanged").Inc()
+			return
+		}
+		tileUploads.WithLabelValues("accepted").Inc()
 
-		c := cur.Coord
-		for z := 1; z <= 5; z++ {
-			c = c.Parent()
-			m.updateZoomLevel(mapid, c, z)
+		err = m.addTileVersion(cur.ID, requestUser(req), f)
+		if err != nil {
+			logger(req).Error("Error recording tile version", "error", err)
 		}
+
+		m.updateZoom(mapid, cur.Coord)
 	}
 }
 
-func (m *Map) updateZoomLevel(mapid int, c Coord, z int) {
-	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+// updateZoomLevel rebuilds a zoom tile from its children and reports whether
+// its image changed.
+func (m *Map) updateZoomLevel(mapid int, c Coord, z int) bool {
+	start := time.Now()
+	defer func() {
+		zoomDuration.WithLabelValues(strconv.Itoa(z)).Observe(time.Since(start).Seconds())
+	}()
+	img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
 	draw.Draw(img, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+	scaler := m.resampler()
 	for x := 0; x <= 1; x++ {
 		for y := 0; y <= 1; y++ {
 			subC := c
@@ -679,26 +777,27 @@ func (m *Map) updateZoomLevel(mapid int, c Coord, z int) {
 			if td == nil || td.File == "" {
 				continue
 			}
-			subf, err := os.Open(filepath.Join(m.gridStorage, td.File))
+			subimg, err := decodeTile(m.tiles, td.File)
 			if err != nil {
 				continue
 			}
-			subimg, _, err := image.Decode(subf)
-			subf.Close()
-			if err != nil {
-				continue
-			}
-			draw.BiLinear.Scale(img, image.Rect(50*x, 50*y, 50*x+50, 50*y+50), subimg, subimg.Bounds(), draw.Src, nil)
+			drawQuadrant(img, x, y, subimg, scaler)
 		}
 	}
-	os.MkdirAll(fmt.Sprintf("%s/%d/%d", m.gridStorage, mapid, z), 0600)
-	f, err := os.Create(fmt.Sprintf("%s/%d/%d/%s.png", m.gridStorage, mapid, z, c.Name()))
-	m.SaveTile(mapid, c, z, fmt.Sprintf("%d/%d/%s.png", mapid, z, c.Name()), time.Now().UnixNano())
-	if err != nil {
-		return
+	data, err := encodePNG(img)
+	if err == nil {
+		var file string
+		file, err = m.putBlob(data)
+		if err == nil {
+			return m.SaveTile(mapid, c, z, file, time.Now().UnixNano())
+		}
 	}
-	defer func() {
-		f.Close()
-	}()
-	png.Encode(f, img)
+	slog.Error("Error writing zoom tile", "map", mapid, "zoom", z, "coord", c, "error", err)
+	return false
+}
+
+// drawQuadrant scales a child tile into quadrant x, y of its parent.
+func drawQuadrant(img *image.NRGBA, x, y int, subimg image.Image, scaler draw.Scaler) {
+	const half = tileSize / 2
+	scaler.Scale(img, image.Rect(half*x, half*y, half*x+half, half*y+half), subimg, subimg.Bounds(), draw.Src, nil)
 }
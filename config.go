@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.etcd.io/bbolt"
+
+	"github.com/andyleap/hnh-map/tilestore"
+)
+
+// Duration is a time.Duration written as "30m" or "10s" in config files and
+// the environment.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// ServerConfig holds the server settings. Values come from the defaults below,
+// then the config file, then HNHMAP_* environment variables and finally any
+// flags given on the command line.
+type ServerConfig struct {
+	Port        int    `toml:"port" env:"HNHMAP_PORT" flag:"port"`
+	GridStorage string `toml:"grids" env:"HNHMAP_GRIDS" flag:"grids"`
+	// Templates and static files are embedded in the binary, the
+	// directories are only read in dev mode. The frontend is also read from
+	// disk when it wasn't built before the binary, or with the nofrontend tag.
+	Dev          bool   `toml:"dev" env:"HNHMAP_DEV" flag:"dev"`
+	TemplatesDir string `toml:"templates" env:"HNHMAP_TEMPLATES"`
+	FrontendDir  string `toml:"frontend" env:"HNHMAP_FRONTEND"`
+	PublicDir    string `toml:"public" env:"HNHMAP_PUBLIC"`
+	// BasePath is the path everything is served under, e.g. /hnh/
+	BasePath string `toml:"base_path" env:"HNHMAP_BASE_PATH"`
+
+	// TLS is served on Port when a certificate or ACME domains are set,
+	// HTTPPort then redirects plain HTTP and answers ACME challenges.
+	HTTPPort      int    `toml:"http_port" env:"HNHMAP_HTTP_PORT"`
+	TLSCert       string `toml:"tls_cert" env:"HNHMAP_TLS_CERT"`
+	TLSKey        string `toml:"tls_key" env:"HNHMAP_TLS_KEY"`
+	ACMEDomains   string `toml:"acme_domains" env:"HNHMAP_ACME_DOMAINS"`
+	ACMEEmail     string `toml:"acme_email" env:"HNHMAP_ACME_EMAIL"`
+	ACMECacheDir  string `toml:"acme_cache_dir" env:"HNHMAP_ACME_CACHE_DIR"`
+	ACMEDirectory string `toml:"acme_directory" env:"HNHMAP_ACME_DIRECTORY"`
+
+	// TileStore is "file" to keep tile images in the grids directory, "bolt"
+	// to keep them in the database or "s3" to keep them in an S3 compatible
+	// bucket.
+	TileStore   string `toml:"tile_store" env:"HNHMAP_TILE_STORE"`
+	S3Endpoint  string `toml:"s3_endpoint" env:"HNHMAP_S3_ENDPOINT"`
+	S3AccessKey string `toml:"s3_access_key" env:"HNHMAP_S3_ACCESS_KEY"`
+	S3SecretKey string `toml:"s3_secret_key" env:"HNHMAP_S3_SECRET_KEY"`
+	S3Region    string `toml:"s3_region" env:"HNHMAP_S3_REGION"`
+	S3Bucket    string `toml:"s3_bucket" env:"HNHMAP_S3_BUCKET"`
+	S3Prefix    string `toml:"s3_prefix" env:"HNHMAP_S3_PREFIX"`
+	S3UseSSL    bool   `toml:"s3_use_ssl" env:"HNHMAP_S3_USE_SSL"`
+	// TileWebP sends tiles as lossless WebP to browsers that accept it.
+	TileWebP bool `toml:"tile_webp" env:"HNHMAP_TILE_WEBP"`
+	// PublicTiles signs tile URLs so they can be served without a session
+	// and cached by a shared cache.
+	PublicTiles bool `toml:"public_tiles" env:"HNHMAP_PUBLIC_TILES"`
+	// TilePlaceholder is served for missing tiles, "transparent" or
+	// "unexplored", they are answered with a 404 if empty.
+	TilePlaceholder string `toml:"tile_placeholder" env:"HNHMAP_TILE_PLACEHOLDER"`
+
+	MetricsAllow string `toml:"metrics_allow" env:"HNHMAP_METRICS_ALLOW" flag:"metrics-allow"`
+	LogLevel     string `toml:"log_level" env:"HNHMAP_LOG_LEVEL" flag:"log-level"`
+	LogFormat    string `toml:"log_format" env:"HNHMAP_LOG_FORMAT" flag:"log-format"`
+
+	// NextUpdate is how long a grid image is kept before a new upload
+	// replaces it.
+	NextUpdate       Duration `toml:"next_update" env:"HNHMAP_NEXT_UPDATE"`
+	CharacterTimeout Duration `toml:"character_timeout" env:"HNHMAP_CHARACTER_TIMEOUT"`
+	ShutdownTimeout  Duration `toml:"shutdown_timeout" env:"HNHMAP_SHUTDOWN_TIMEOUT"`
+	ZoomLevels       int      `toml:"zoom_levels" env:"HNHMAP_ZOOM_LEVELS"`
+	ZoomWorkers      int      `toml:"zoom_workers" env:"HNHMAP_ZOOM_WORKERS"`
+	MaxUploadSize    int64    `toml:"max_upload_size" env:"HNHMAP_MAX_UPLOAD_SIZE"`
+	MaxImportSize    int64    `toml:"max_import_size" env:"HNHMAP_MAX_IMPORT_SIZE"`
+	// MaxRenderSize limits the width and height of rendered map images.
+	MaxRenderSize int `toml:"max_render_size" env:"HNHMAP_MAX_RENDER_SIZE"`
+}
+
+func (c ServerConfig) tileStore(db *bbolt.DB) (tilestore.Store, error) {
+	switch c.TileStore {
+	case "bolt":
+		return tilestore.NewBolt(db, "tilestore")
+	case "s3":
+		return tilestore.NewS3(tilestore.S3Config{
+			Endpoint:  c.S3Endpoint,
+			AccessKey: c.S3AccessKey,
+			SecretKey: c.S3SecretKey,
+			Region:    c.S3Region,
+			Bucket:    c.S3Bucket,
+			Prefix:    c.S3Prefix,
+			UseSSL:    c.S3UseSSL,
+		})
+	}
+	return tilestore.NewFS(c.GridStorage), nil
+}
+
+func defaultConfig() ServerConfig {
+	return ServerConfig{
+		Port:             8080,
+		GridStorage:      "grids",
+		TemplatesDir:     "templates",
+		FrontendDir:      "frontend",
+		PublicDir:        "public",
+		BasePath:         "/",
+		TileStore:        "file",
+		S3UseSSL:         true,
+		LogLevel:         "info",
+		LogFormat:        "text",
+		NextUpdate:       Duration{30 * time.Minute},
+		CharacterTimeout: Duration{10 * time.Second},
+		ShutdownTimeout:  Duration{30 * time.Second},
+		ZoomLevels:       5,
+		ZoomWorkers:      2,
+		MaxUploadSize:    100000000,
+		MaxImportSize:    500 * 1024 * 1024,
+		MaxRenderSize:    10000,
+	}
+}
+
+// loadConfig builds the effective config. file may be empty, flags set on fs
+// take precedence over everything else.
+func loadConfig(file string, fs *flag.FlagSet) (ServerConfig, error) {
+	cfg := defaultConfig()
+	if file != "" {
+		md, err := toml.DecodeFile(file, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("reading %s: %w", file, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return cfg, fmt.Errorf("unknown settings in %s: %v", file, undecoded)
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	v := reflect.ValueOf(&cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if name := field.Tag.Get("env"); name != "" {
+			if env, ok := os.LookupEnv(name); ok {
+				err := setField(v.Field(i), env)
+				if err != nil {
+					return cfg, fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		}
+		if name := field.Tag.Get("flag"); name != "" && set[name] {
+			err := setField(v.Field(i), fs.Lookup(name).Value.String())
+			if err != nil {
+				return cfg, fmt.Errorf("-%s: %w", name, err)
+			}
+		}
+	}
+	if !strings.HasSuffix(cfg.BasePath, "/") {
+		cfg.BasePath += "/"
+	}
+	return cfg, cfg.validate()
+}
+
+func setField(f reflect.Value, s string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.Type())
+	}
+	return nil
+}
+
+func (c ServerConfig) validate() error {
+	errs := []string{}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, "port must be between 1 and 65535")
+	}
+	if c.HTTPPort < 0 || c.HTTPPort > 65535 || (c.HTTPPort != 0 && c.HTTPPort == c.Port) {
+		errs = append(errs, "http_port must be between 1 and 65535 and differ from port, or 0 to disable")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, "tls_cert and tls_key must be set together")
+	}
+	if c.TLSCert != "" && c.ACMEDomains != "" {
+		errs = append(errs, "tls_cert and acme_domains can not both be set")
+	}
+	if c.ACMEDomains != "" && len(c.acmeDomains()) == 0 {
+		errs = append(errs, "acme_domains must list at least one domain")
+	}
+	if !strings.HasPrefix(c.BasePath, "/") {
+		errs = append(errs, "base_path must start with /")
+	}
+	switch c.TileStore {
+	case "file", "bolt":
+	case "s3":
+		if c.S3Endpoint == "" || c.S3Bucket == "" {
+			errs = append(errs, "s3_endpoint and s3_bucket must be set for the s3 tile store")
+		}
+	default:
+		errs = append(errs, "tile_store must be file, bolt or s3")
+	}
+	switch c.TilePlaceholder {
+	case "", "transparent", "unexplored":
+	default:
+		errs = append(errs, "tile_placeholder must be transparent, unexplored or empty")
+	}
+	if c.GridStorage == "" {
+		errs = append(errs, "grids must be set")
+	}
+	for _, d := range []struct {
+		name, dir string
+		used      bool
+	}{
+		{"templates", c.TemplatesDir, c.Dev},
+		{"frontend", c.FrontendDir, c.Dev || embeddedFrontend() == nil},
+		{"public", c.PublicDir, c.Dev},
+	} {
+		if !d.used {
+			continue
+		}
+		if st, err := os.Stat(d.dir); err != nil || !st.IsDir() {
+			errs = append(errs, fmt.Sprintf("%s directory %q does not exist", d.name, d.dir))
+		}
+	}
+	if c.NextUpdate.Duration < 0 {
+		errs = append(errs, "next_update must not be negative")
+	}
+	if c.CharacterTimeout.Duration <= 0 {
+		errs = append(errs, "character_timeout must be positive")
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, "shutdown_timeout must be positive")
+	}
+	if c.ZoomLevels < 1 || c.ZoomLevels > 10 {
+		errs = append(errs, "zoom_levels must be between 1 and 10")
+	}
+	if c.ZoomWorkers < 1 {
+		errs = append(errs, "zoom_workers must be at least 1")
+	}
+	if c.MaxUploadSize <= 0 {
+		errs = append(errs, "max_upload_size must be positive")
+	}
+	if c.MaxImportSize <= 0 {
+		errs = append(errs, "max_import_size must be positive")
+	}
+	if c.MaxRenderSize < tileSize {
+		errs = append(errs, fmt.Sprintf("max_render_size must be at least %d", tileSize))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// LogValue lets the effective config be logged at startup, with secrets
+// masked.
+func (c ServerConfig) LogValue() slog.Value {
+	if c.S3SecretKey != "" {
+		c.S3SecretKey = "***"
+	}
+	attrs := []slog.Attr{}
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		attrs = append(attrs, slog.Any(t.Field(i).Tag.Get("toml"), fmt.Sprint(v.Field(i).Interface())))
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -1,10 +1,16 @@
 import L, {Bounds, LatLng, Point} from "leaflet"
 import {getTileUrl} from "../main";
 
-export const TileSize = 100;
-export const HnHMaxZoom = 6;
+export let TileSize = 100;
+export let HnHMaxZoom = 6;
 export const HnHMinZoom = 1;
 
+// setTileConfig applies the tile size and zoom levels served by the map config
+export function setTileConfig(config) {
+    TileSize = config.tileSize;
+    HnHMaxZoom = HnHMinZoom + config.zoomLevels;
+}
+
 export const GridCoordLayer = L.GridLayer.extend({
     createTile: function (coords) {
         let element = document.createElement("div");
@@ -37,21 +43,21 @@ export const ImageIcon = L.Icon.extend({
     }
 });
 
-const latNormalization = 90.0 * TileSize / 2500000.0;
-const lngNormalization = 180.0 * TileSize / 2500000.0;
+const latNormalization = () => 90.0 * TileSize / 2500000.0;
+const lngNormalization = () => 180.0 * TileSize / 2500000.0;
 
 const HnHProjection = {
     project: function (latlng) {
-        return new Point(latlng.lat / latNormalization, latlng.lng / lngNormalization);
+        return new Point(latlng.lat / latNormalization(), latlng.lng / lngNormalization());
     },
 
     unproject: function (point) {
-        return new LatLng(point.x * latNormalization, point.y * lngNormalization);
+        return new LatLng(point.x * latNormalization(), point.y * lngNormalization());
     },
 
-    bounds: (function () {
-        return new Bounds([-latNormalization, -lngNormalization], [latNormalization, lngNormalization]);
-    })()
+    get bounds() {
+        return new Bounds([-latNormalization(), -lngNormalization()], [latNormalization(), lngNormalization()]);
+    }
 };
 
 export const HnHCRS = L.extend({}, L.CRS.Simple, {
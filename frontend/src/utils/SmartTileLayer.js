@@ -2,8 +2,10 @@ import L, {Bounds, LatLng, Point, Util, Browser} from "leaflet"
 
 export const SmartTileLayer = L.TileLayer.extend({
     cache: {},
+    sigs: {},
     invalidTile: "",
     map: 0,
+    at: 0,
 
     getTileUrl: function(coords) {
 		return this.getTrueTileUrl(coords, this._getZoomForUrl());
@@ -26,13 +28,20 @@ export const SmartTileLayer = L.TileLayer.extend({
 			data['-y'] = invertedY;
         }
         
-        data['cache'] = this.cache[data['map'] + ':'+ data['x'] + ':' + data['y'] + ':' + data['z']];
+        var key = data['map'] + ':'+ data['x'] + ':' + data['y'] + ':' + data['z'];
+        data['cache'] = this.cache[key];
 
         if(!data['cache'] || data['cache'] == -1) {
             return this.invalidTile;
         }
 
-		return Util.template(this._url, Util.extend(data, this.options));
+		var url = Util.template(this._url, Util.extend(data, this.options));
+        if (this.at) {
+            url += '&at=' + this.at;
+        } else if (this.sigs[key]) {
+            url += '&sig=' + this.sigs[key];
+        }
+        return url;
     },
 
     refresh: function(x, y, z)  {
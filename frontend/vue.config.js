@@ -1,3 +1,3 @@
 module.exports = {
-    publicPath: '/map'
+    publicPath: ''
   }
\ No newline at end of file
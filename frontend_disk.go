@@ -0,0 +1,9 @@
+//go:build nofrontend
+
+package main
+
+import "io/fs"
+
+func embeddedFrontend() fs.FS {
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !nofrontend
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The frontend is built into frontend/dist by npm run build. Until it has
+// been, only a placeholder is embedded and the frontend is read from disk.
+//
+//go:embed all:frontend/dist
+var frontendDist embed.FS
+
+func embeddedFrontend() fs.FS {
+	dist, _ := fs.Sub(frontendDist, "frontend/dist")
+	if _, err := fs.Stat(dist, "index.html"); err != nil {
+		return nil
+	}
+	return dist
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// The gridcoords bucket indexes grids by where they are, keyed
+// {map}/{x}_{y}/{id}, so the grids of a map or a coord can be found without
+// going through every grid. Merges can leave more than one grid on a coord.
+
+func gridCoordPrefix(mapid int, c Coord) []byte {
+	return []byte(fmt.Sprintf("%d/%s/", mapid, c.Name()))
+}
+
+func indexGrid(tx *bbolt.Tx, gd GridData) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("gridcoords"))
+	if err != nil {
+		return err
+	}
+	return b.Put(append(gridCoordPrefix(gd.Map, gd.Coord), gd.ID...), []byte{})
+}
+
+func unindexGrid(tx *bbolt.Tx, gd GridData) error {
+	b := tx.Bucket([]byte("gridcoords"))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(append(gridCoordPrefix(gd.Map, gd.Coord), gd.ID...))
+}
+
+// reindexGrids rebuilds the index, for operations moving many grids at once.
+func reindexGrids(tx *bbolt.Tx) error {
+	if tx.Bucket([]byte("gridcoords")) != nil {
+		err := tx.DeleteBucket([]byte("gridcoords"))
+		if err != nil {
+			return err
+		}
+	}
+	grids := tx.Bucket([]byte("grids"))
+	if grids == nil {
+		return nil
+	}
+	return grids.ForEach(func(k, v []byte) error {
+		gd := GridData{}
+		err := json.Unmarshal(v, &gd)
+		if err != nil {
+			return err
+		}
+		return indexGrid(tx, gd)
+	})
+}
+
+// indexedGrids returns the grids whose index key starts with prefix.
+func indexedGrids(tx *bbolt.Tx, prefix []byte) []GridData {
+	found := []GridData{}
+	b := tx.Bucket([]byte("gridcoords"))
+	grids := tx.Bucket([]byte("grids"))
+	if b == nil || grids == nil {
+		return found
+	}
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		raw := grids.Get(k[bytes.LastIndexByte(k, '/')+1:])
+		if raw == nil {
+			continue
+		}
+		gd := GridData{}
+		json.Unmarshal(raw, &gd)
+		found = append(found, gd)
+	}
+	return found
+}
+
+// gridsAt returns the grids on a coord of a map.
+func gridsAt(tx *bbolt.Tx, mapid int, c Coord) []GridData {
+	return indexedGrids(tx, gridCoordPrefix(mapid, c))
+}
+
+// mapGrids returns every grid of a map.
+func mapGrids(tx *bbolt.Tx, mapid int) []GridData {
+	return indexedGrids(tx, []byte(fmt.Sprintf("%d/", mapid)))
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+
+	"go.etcd.io/bbolt"
+)
+
+// parseAt accepts either unix seconds or an RFC3339 timestamp.
+func parseAt(at string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(at, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, at)
+}
+
+// gridIndex maps the current coordinates of every grid on a map to its ID.
+func (m *Map) gridIndex(mapid int) map[Coord]string {
+	index := map[Coord]string{}
+	m.db.View(func(tx *bbolt.Tx) error {
+		for _, gd := range mapGrids(tx, mapid) {
+			index[gd.Coord] = gd.ID
+		}
+		return nil
+	})
+	return index
+}
+
+// historicFile returns the image of a grid that was current at t, or "" if
+// the grid had no image yet.
+func (m *Map) historicFile(gridID string, t time.Time) string {
+	versions := m.getTileVersions(gridID)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].Time.After(t) {
+			return versions[i].File
+		}
+	}
+	return ""
+}
+
+// lastVersionTime returns the time of the newest version of any grid in
+// index uploaded at or before t. The map looks the same at any time between
+// it and the next upload, so historic views are cached by it.
+func (m *Map) lastVersionTime(index map[Coord]string, t time.Time) (time.Time, bool) {
+	last := time.Time{}
+	found := false
+	m.db.View(func(tx *bbolt.Tx) error {
+		history := tx.Bucket([]byte("history"))
+		if history == nil {
+			return nil
+		}
+		for _, gridID := range index {
+			b := history.Bucket([]byte(gridID))
+			if b == nil {
+				continue
+			}
+			b.ForEach(func(k, v []byte) error {
+				tv := TileVersion{}
+				json.Unmarshal(v, &tv)
+				if !tv.Time.After(t) && (!found || tv.Time.After(last)) {
+					last, found = tv.Time, true
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return last, found
+}
+
+// historicCachePrefix holds the rendered historic tiles in the cache store,
+// apart from the WebP tiles.
+const historicCachePrefix = "historic"
+
+func historicCacheFile(mapid int, c Coord, z int, t time.Time) string {
+	return fmt.Sprintf("%s/%d/%d/%s_%d.png", historicCachePrefix, mapid, z, c.Name(), t.UnixNano())
+}
+
+func (m *Map) clearHistoricCache(mapid int) {
+	m.historic.drop(mapid, time.Time{})
+	m.cache.RemoveAll(historicCachePrefix + "/" + strconv.Itoa(mapid))
+}
+
+// maxHistoricViews bounds the views kept in memory. A map view asks for
+// dozens of tiles at the same time, so only a few are needed at once.
+const maxHistoricViews = 32
+
+type historicKey struct {
+	mapid int
+	t     int64
+}
+
+type historicEntry struct {
+	view *historicView // nil if the map had no images at t
+	used time.Time
+}
+
+// historicViews caches historic views, as building one goes through every
+// grid of the map and its history. Changes to a map drop the views they
+// affect, gen keeps a view built during a change from being kept.
+type historicViews struct {
+	mu    sync.Mutex
+	gen   uint64
+	views map[historicKey]*historicEntry
+}
+
+func (v *historicViews) get(mapid int, t time.Time) (h *historicView, found bool, gen uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	e := v.views[historicKey{mapid, t.UnixNano()}]
+	if e == nil {
+		return nil, false, v.gen
+	}
+	e.used = time.Now()
+	return e.view, true, v.gen
+}
+
+func (v *historicViews) put(mapid int, t time.Time, h *historicView, gen uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if gen != v.gen {
+		return
+	}
+	if v.views == nil {
+		v.views = map[historicKey]*historicEntry{}
+	}
+	if len(v.views) >= maxHistoricViews {
+		var oldest historicKey
+		var oldestUsed time.Time
+		for k, e := range v.views {
+			if oldestUsed.IsZero() || e.used.Before(oldestUsed) {
+				oldest, oldestUsed = k, e.used
+			}
+		}
+		delete(v.views, oldest)
+	}
+	v.views[historicKey{mapid, t.UnixNano()}] = &historicEntry{view: h, used: time.Now()}
+}
+
+// drop forgets the views of a map at or after since, or all of them if since
+// is zero. A mapid below 0 drops the views of every map.
+func (v *historicViews) drop(mapid int, since time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.gen++
+	for k := range v.views {
+		if (mapid < 0 || k.mapid == mapid) && (since.IsZero() || k.t >= since.UnixNano()) {
+			delete(v.views, k)
+		}
+	}
+}
+
+// historicView is a map as it looked at t, where version is the time of the
+// last upload at or before t.
+type historicView struct {
+	mapid   int
+	index   map[Coord]string
+	t       time.Time
+	version time.Time
+	// occupied holds the tiles of each zoom level that have grids under them
+	occupied []map[Coord]bool
+}
+
+// historicView returns the cached view of a map at t, building it if needed.
+func (m *Map) historicView(mapid int, t time.Time) (*historicView, bool) {
+	h, found, gen := m.historic.get(mapid, t)
+	if !found {
+		h, _ = m.newHistoricView(mapid, t)
+		m.historic.put(mapid, t, h, gen)
+	}
+	return h, h != nil
+}
+
+func (m *Map) newHistoricView(mapid int, t time.Time) (*historicView, bool) {
+	h := &historicView{
+		mapid:    mapid,
+		index:    m.gridIndex(mapid),
+		t:        t,
+		occupied: make([]map[Coord]bool, m.cfg.ZoomLevels+1),
+	}
+	var ok bool
+	h.version, ok = m.lastVersionTime(h.index, t)
+	if !ok {
+		return nil, false
+	}
+	for z := range h.occupied {
+		h.occupied[z] = map[Coord]bool{}
+		for c := range h.index {
+			h.occupied[z][Coord{X: c.X >> z, Y: c.Y >> z}] = true
+		}
+	}
+	return h, true
+}
+
+// historicImage renders the tile as it looked at h.t. Zoom levels above 0 are
+// built from their children and cached once h.t lies in the past, as images
+// current at that time can no longer change.
+func (m *Map) historicImage(h *historicView, c Coord, z int) image.Image {
+	if !h.occupied[z][c] {
+		return nil
+	}
+	if z == 0 {
+		file := m.historicFile(h.index[c], h.t)
+		if file == "" {
+			return nil
+		}
+		img, err := decodeTile(m.tiles, file)
+		if err != nil {
+			return nil
+		}
+		return img
+	}
+
+	cacheFile := historicCacheFile(h.mapid, c, z, h.version)
+	if img, err := decodeTile(m.cache, cacheFile); err == nil {
+		return img
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	draw.Draw(img, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+	scaler := m.resampler()
+	empty := true
+	for x := 0; x <= 1; x++ {
+		for y := 0; y <= 1; y++ {
+			subC := Coord{X: c.X*2 + x, Y: c.Y*2 + y}
+			subimg := m.historicImage(h, subC, z-1)
+			if subimg == nil {
+				continue
+			}
+			empty = false
+			drawQuadrant(img, x, y, subimg, scaler)
+		}
+	}
+
+	if empty {
+		return nil
+	}
+	if h.t.Before(time.Now()) {
+		err := putPNG(m.cache, cacheFile, img)
+		if err != nil {
+			slog.Warn("Error caching historic tile", "file", cacheFile, "error", err)
+		}
+	}
+	return img
+}
+
+func (m *Map) historicTile(rw http.ResponseWriter, req *http.Request, mapid int, c Coord, z int, at string) {
+	t, err := parseAt(at)
+	if err != nil {
+		http.Error(rw, "request parsing error", http.StatusBadRequest)
+		return
+	}
+	if z < 0 || z > m.cfg.ZoomLevels {
+		http.Error(rw, fmt.Sprintf("zoom must be between 0 and %d", m.cfg.ZoomLevels), http.StatusBadRequest)
+		return
+	}
+
+	h, ok := m.historicView(mapid, t)
+	if !ok {
+		http.Error(rw, "file not found", 404)
+		return
+	}
+	// Like versioned tile URLs, the map at a time in the past doesn't change,
+	// while the present still does
+	cacheControl := "private, no-cache"
+	if t.Before(time.Now()) {
+		cacheControl = "private, max-age=31536000, immutable"
+	}
+	if z > 0 {
+		cacheFile := historicCacheFile(mapid, c, z, h.version)
+		if f, err := m.cache.Open(cacheFile); err == nil {
+			defer f.Close()
+			rw.Header().Set("Content-Type", "image/png")
+			rw.Header().Set("Cache-Control", cacheControl)
+			http.ServeContent(rw, req, "", f.ModTime(), f)
+			return
+		}
+	}
+
+	img := m.historicImage(h, c, z)
+	if img == nil {
+		http.Error(rw, "file not found", 404)
+		return
+	}
+	rw.Header().Set("Content-Type", "image/png")
+	rw.Header().Set("Cache-Control", cacheControl)
+	png.Encode(rw, img)
+}
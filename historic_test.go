@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoricViews(t *testing.T) {
+	v := historicViews{}
+	past := time.Unix(1000, 0)
+	future := time.Unix(2000, 0)
+
+	_, found, gen := v.get(1, past)
+	if found {
+		t.Fatal("found a view in an empty cache")
+	}
+	v.put(1, past, &historicView{mapid: 1}, gen)
+	v.put(1, future, &historicView{mapid: 1}, gen)
+	v.put(2, past, nil, gen)
+	if h, found, _ := v.get(2, past); !found || h != nil {
+		t.Errorf("map without images = %v, %v, want a cached nil view", h, found)
+	}
+
+	v.drop(1, time.Unix(1500, 0))
+	if _, found, _ := v.get(1, past); !found {
+		t.Error("upload dropped a view from before it")
+	}
+	if _, found, _ := v.get(1, future); found {
+		t.Error("upload kept a view from after it")
+	}
+
+	// A view built while the map changed is not kept
+	v.put(1, future, &historicView{mapid: 1}, gen)
+	if _, found, _ := v.get(1, future); found {
+		t.Error("kept a view built before a change")
+	}
+
+	v.drop(-1, time.Time{})
+	if _, found, _ := v.get(2, past); found {
+		t.Error("clearing every map kept a view")
+	}
+
+	_, _, gen = v.get(1, past)
+	for i := 0; i < maxHistoricViews*2; i++ {
+		v.put(1, time.Unix(int64(i), 0), nil, gen)
+	}
+	if len(v.views) > maxHistoricViews {
+		t.Errorf("%d views kept, want at most %d", len(v.views), maxHistoricViews)
+	}
+}
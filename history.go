@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const maxTileVersions = 10
+
+// TileVersion is one uploaded image of a grid, the newest is normally the
+// grid's current image.
+type TileVersion struct {
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	File    string    `json:"file"`
+	Current bool      `json:"current"`
+}
+
+// gridFile is where grid images were stored before tiles were content
+// addressed.
+func gridFile(id string) string {
+	return fmt.Sprintf("grids/%s.png", id)
+}
+
+func (m *Map) getTileVersions(gridID string) []TileVersion {
+	versions := []TileVersion{}
+	m.db.View(func(tx *bbolt.Tx) error {
+		history := tx.Bucket([]byte("history"))
+		if history == nil {
+			return nil
+		}
+		b := history.Bucket([]byte(gridID))
+		if b == nil {
+			return nil
+		}
+		cur := ""
+		if grids := tx.Bucket([]byte("grids")); grids != nil {
+			if raw := grids.Get([]byte(gridID)); raw != nil {
+				gd := GridData{}
+				json.Unmarshal(raw, &gd)
+				if td := m.getTile(tx, gd.Map, gd.Coord, 0); td != nil {
+					cur = td.File
+				}
+			}
+		}
+		return b.ForEach(func(k, v []byte) error {
+			tv := TileVersion{}
+			json.Unmarshal(v, &tv)
+			tv.Current = tv.File == cur
+			versions = append(versions, tv)
+			return nil
+		})
+	})
+	return versions
+}
+
+func (m *Map) getTileVersion(gridID string, version uint64) *TileVersion {
+	for _, tv := range m.getTileVersions(gridID) {
+		if tv.ID == version {
+			return &tv
+		}
+	}
+	return nil
+}
+
+// lastTileVersion returns the newest image of a grid, or "" if it has none.
+func lastTileVersion(tx *bbolt.Tx, gridID string) string {
+	history := tx.Bucket([]byte("history"))
+	if history == nil {
+		return ""
+	}
+	b := history.Bucket([]byte(gridID))
+	if b == nil {
+		return ""
+	}
+	_, v := b.Cursor().Last()
+	if v == nil {
+		return ""
+	}
+	tv := TileVersion{}
+	json.Unmarshal(v, &tv)
+	return tv.File
+}
+
+// addTileVersion records file as the newest image of a grid, unless it
+// already is, and drops the oldest versions beyond maxTileVersions.
+func (m *Map) addTileVersion(gridID string, user string, file string) error {
+	// Views of the grid's map from now on change, dropping old versions
+	// changes the past too
+	mapid := -1
+	var since time.Time
+	added := false
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		if lastTileVersion(tx, gridID) == file {
+			return nil
+		}
+		added = true
+		if grids := tx.Bucket([]byte("grids")); grids != nil {
+			if raw := grids.Get([]byte(gridID)); raw != nil {
+				gd := GridData{}
+				json.Unmarshal(raw, &gd)
+				mapid = gd.Map
+			}
+		}
+		history, err := tx.CreateBucketIfNotExists([]byte("history"))
+		if err != nil {
+			return err
+		}
+		b, err := history.CreateBucketIfNotExists([]byte(gridID))
+		if err != nil {
+			return err
+		}
+		tv := TileVersion{
+			Time: time.Now(),
+			User: user,
+			File: file,
+		}
+		since = tv.Time
+		tv.ID, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(tv)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(fmt.Sprintf("%020d", tv.ID)), raw)
+		if err != nil {
+			return err
+		}
+		err = retainBlob(tx, file)
+		if err != nil {
+			return err
+		}
+		n := 0
+		b.ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		})
+		c := b.Cursor()
+		for ; n > maxTileVersions; n-- {
+			_, v := c.First()
+			if v == nil {
+				break
+			}
+			old := TileVersion{}
+			json.Unmarshal(v, &old)
+			err = releaseBlob(tx, old.File)
+			if err != nil {
+				return err
+			}
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+			since = time.Time{}
+		}
+		return nil
+	})
+	if added {
+		m.historic.drop(mapid, since)
+	}
+	return err
+}
+
+func (m *Map) tileHistory(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_MAP) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(rw).Encode(m.getTileVersions(req.FormValue("grid")))
+}
+
+func (m *Map) tileHistoryImage(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_MAP) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	version, err := strconv.ParseUint(req.FormValue("version"), 10, 64)
+	if err != nil {
+		http.Error(rw, "version parse failed", http.StatusBadRequest)
+		return
+	}
+	tv := m.getTileVersion(req.FormValue("grid"), version)
+	if tv == nil {
+		http.Error(rw, "file not found", 404)
+		return
+	}
+	serveTile(rw, req, m.tiles, tv.File, time.Time{})
+}
+
+func (m *Map) rollbackGrid(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
+		m.redirect(rw, req, "/")
+		return
+	}
+	gridID := req.FormValue("grid")
+	version, err := strconv.ParseUint(req.FormValue("version"), 10, 64)
+	if err != nil {
+		http.Error(rw, "version parse failed", http.StatusBadRequest)
+		return
+	}
+	tv := m.getTileVersion(gridID, version)
+	if tv == nil {
+		http.Error(rw, "version not found", 404)
+		return
+	}
+	if tv.Current {
+		rw.WriteHeader(200)
+		return
+	}
+	cur := GridData{}
+	err = m.db.View(func(tx *bbolt.Tx) error {
+		grids := tx.Bucket([]byte("grids"))
+		if grids == nil {
+			return fmt.Errorf("Unknown grid id: %s", gridID)
+		}
+		curRaw := grids.Get([]byte(gridID))
+		if curRaw == nil {
+			return fmt.Errorf("Unknown grid id: %s", gridID)
+		}
+		return json.Unmarshal(curRaw, &cur)
+	})
+	if err != nil {
+		http.Error(rw, err.Error(), 404)
+		return
+	}
+
+	err = m.addTileVersion(gridID, s.Username, tv.File)
+	if err != nil {
+		logger(req).Error("Error recording tile version", "grid", gridID, "error", err)
+	}
+	m.audit(req, s, "rollbackGrid", cur.Map, []string{gridID}, map[string]string{
+		"version": strconv.FormatUint(version, 10),
+	})
+
+	if m.SaveTile(cur.Map, cur.Coord, 0, tv.File, time.Now().UnixNano()) {
+		m.updateZoom(cur.Map, cur.Coord)
+	}
+	rw.WriteHeader(200)
+}
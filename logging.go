@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// setupLogging installs the default logger. format is "text" or "json".
+func setupLogging(level, format string) error {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text", "":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// logger returns the request scoped logger, carrying the request ID and any
+// fields attached by the handlers along the way.
+func logger(req *http.Request) *slog.Logger {
+	if l, ok := req.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// withLogger returns req with extra fields attached to its logger.
+func withLogger(req *http.Request, args ...any) *http.Request {
+	l := logger(req).With(args...)
+	return req.WithContext(context.WithValue(req.Context(), loggerKey{}, l))
+}
+
+// requestID tags every request with an ID, reusing X-Request-ID from a
+// proxy if there is one.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if id == "" {
+			raw := make([]byte, 8)
+			rand.Read(raw)
+			id = hex.EncodeToString(raw)
+		}
+		rw.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(rw, withLogger(req, "request_id", id))
+	})
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/andyleap/hnh-map/tilestore"
 	"github.com/andyleap/hnh-map/webapp"
 
 	"go.etcd.io/bbolt"
@@ -20,14 +29,34 @@ import (
 type Map struct {
 	gridStorage string
 	db          *bbolt.DB
+	cfg         ServerConfig
+
+	// tiles holds grid, zoom and history images, cache holds rendered
+	// historic tiles, which are always kept on local disk.
+	tiles tilestore.Store
+	cache tilestore.Store
+	// blobmu keeps images from being swept while they are being stored
+	blobmu sync.Mutex
+	zooms  *zoomQueue
+	// tileKey signs tile URLs in public tiles mode
+	tileKey []byte
+
+	placeholder     []byte
+	placeholderOnce sync.Once
 
 	characters map[string]Character
 	chmu       sync.RWMutex
 
+	stats pendingStats
+	// historic caches the grids of maps as they were at a time
+	historic historicViews
+
 	*webapp.WebApp
 
 	gridUpdates  topic
 	mergeUpdates mergeTopic
+
+	ready atomic.Bool
 }
 
 type Session struct {
@@ -38,33 +67,63 @@ type Session struct {
 }
 
 var (
-	gridStorage = flag.String("grids", "grids", "directory to store grids in")
-	port        = flag.Int("port", func() int {
-		if port, ok := os.LookupEnv("HNHMAP_PORT"); ok {
-			p, err := strconv.Atoi(port)
-			if err != nil {
-				log.Fatal(err)
-			}
-			return p
-		}
-		return 8080
-	}(), "Port to listen on")
+	configFile = flag.String("config", os.Getenv("HNHMAP_CONFIG"), "TOML config file")
+	_          = flag.String("grids", defaultConfig().GridStorage, "directory to store grids in")
+	_          = flag.Int("port", defaultConfig().Port, "Port to listen on")
+	_          = flag.String("metrics-allow", "", "Comma separated CIDRs allowed to read /metrics, metrics are disabled if empty")
+	_          = flag.String("log-level", defaultConfig().LogLevel, "Log level (debug, info, warn, error)")
+	_          = flag.String("log-format", defaultConfig().LogFormat, "Log format (text, json)")
+	_          = flag.Bool("dev", false, "Serve templates and static files from disk and reload templates on every request")
 )
 
 func main() {
 	flag.Parse()
 
-	db, err := bbolt.Open(*gridStorage+"/grids.db", 0600, nil)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	cfg, err := loadConfig(*configFile, flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setupLogging(cfg.LogLevel, cfg.LogFormat)
 	if err != nil {
 		log.Fatal(err)
 	}
+	slog.Info("Effective configuration", "config", cfg)
+
+	templatesFS, publicFS, frontendFS := cfg.assets()
+	web, err := webapp.New().LoadTemplatesFS(templatesFS)
+	if err != nil {
+		fatal("Error loading templates", "error", err)
+	}
+	if cfg.Dev {
+		web.HotReload()
+	}
+
+	db, err := bbolt.Open(cfg.GridStorage+"/grids.db", 0600, nil)
+	if err != nil {
+		fatal("Error opening database", "error", err)
+	}
+
+	tiles, err := cfg.tileStore(db)
+	if err != nil {
+		fatal("Error opening tile store", "error", err)
+	}
 	m := Map{
-		gridStorage: *gridStorage,
+		gridStorage: cfg.GridStorage,
 		db:          db,
+		cfg:         cfg,
+		tiles:       tiles,
+		cache:       tilestore.NewFS(filepath.Join(cfg.GridStorage, "historycache")),
 
 		characters: map[string]Character{},
+		zooms:      newZoomQueue(),
+
+		gridUpdates:  topic{name: "tiles"},
+		mergeUpdates: mergeTopic{name: "merges"},
 
-		WebApp: webapp.Must(webapp.New().LoadTemplates("./templates/")),
+		WebApp: web,
 	}
 
 	err = db.Update(func(tx *bbolt.Tx) error {
@@ -85,10 +144,48 @@ func main() {
 		return b.Put([]byte("version"), []byte(strconv.Itoa(len(migrations))))
 	})
 	if err != nil {
-		log.Fatal(err)
+		fatal("Error running migrations", "error", err)
+	}
+	err = m.migrateTileStore()
+	if err != nil {
+		fatal("Error moving tile images", "error", err)
+	}
+	err = m.migrateBlobs()
+	if err != nil {
+		fatal("Error moving tile images", "error", err)
+	}
+	err = m.migrateZoomLevels()
+	if err != nil {
+		fatal("Error changing zoom levels", "error", err)
+	}
+	if cfg.PublicTiles {
+		m.tileKey, err = m.loadTileKey()
+		if err != nil {
+			fatal("Error loading tile signing key", "error", err)
+		}
+	}
+	m.ready.Store(true)
+
+	go m.cleanChars(ctx)
+	go m.sweepBlobs(ctx)
+	go m.flushStatsLoop(ctx)
+	zoomsDone := make(chan struct{})
+	go func() {
+		m.runZoomWorkers(ctx, cfg.ZoomWorkers)
+		close(zoomsDone)
+	}()
+
+	m.registerMetrics()
+	if cfg.MetricsAllow != "" {
+		h, err := metricsHandler(cfg.MetricsAllow)
+		if err != nil {
+			fatal("Invalid metrics allowlist", "error", err)
+		}
+		http.Handle("/metrics", h)
 	}
 
-	go m.cleanChars()
+	http.HandleFunc("/healthz", m.healthz)
+	http.HandleFunc("/readyz", m.readyz)
 
 	// Mapping client endpoints
 	http.HandleFunc("/client/", m.client)
@@ -97,6 +194,7 @@ func main() {
 	http.HandleFunc("/logout", m.logout)
 	http.HandleFunc("/", m.index)
 	http.HandleFunc("/generateToken", m.generateToken)
+	http.HandleFunc("/generateAPIKey", m.generateAPIKey)
 	http.HandleFunc("/password", m.changePassword)
 
 	// Admin endpoints
@@ -107,30 +205,115 @@ func main() {
 	http.HandleFunc("/admin/setPrefix", m.setPrefix)
 	http.HandleFunc("/admin/setDefaultHide", m.setDefaultHide)
 	http.HandleFunc("/admin/setTitle", m.setTitle)
+	http.HandleFunc("/admin/setResample", m.setResample)
 	http.HandleFunc("/admin/rebuildZooms", m.rebuildZooms)
 	http.HandleFunc("/admin/export", m.export)
 	http.HandleFunc("/admin/merge", m.merge)
 	http.HandleFunc("/admin/map", m.adminMap)
 	http.HandleFunc("/admin/mapic", m.adminICMap)
+	http.HandleFunc("/admin/audit", m.adminAudit)
+	http.HandleFunc("/admin/revert", m.revert)
+	http.HandleFunc("/admin/stats", m.adminStats)
+	http.HandleFunc("/admin/status", m.adminStatus)
 
 	// Map frontend endpoints
 	http.HandleFunc("/map/api/v1/characters", m.getChars)
 	http.HandleFunc("/map/api/v1/markers", m.getMarkers)
+	http.HandleFunc("/map/api/v1/tileInfo", m.tileInfo)
+	http.HandleFunc("/map/api/v1/render", m.render)
 	http.HandleFunc("/map/api/config", m.config)
 	http.HandleFunc("/map/api/admin/wipeTile", m.wipeTile)
 	http.HandleFunc("/map/api/admin/setCoords", m.setCoords)
 	http.HandleFunc("/map/api/admin/hideMarker", m.hideMarker)
+	http.HandleFunc("/map/api/admin/rollbackGrid", m.rollbackGrid)
+	http.HandleFunc("/map/api/v1/history", m.tileHistory)
+	http.HandleFunc("/map/api/v1/history/tile", m.tileHistoryImage)
 	http.HandleFunc("/map/updates", m.watchGridUpdates)
 	http.HandleFunc("/map/grids/", m.gridTile)
 	http.HandleFunc("/map/api/maps", m.getMaps)
+	http.HandleFunc("/map/xyz/", m.xyzTile)
+	http.HandleFunc("/map/wmts/WMTSCapabilities.xml", m.wmtsCapabilities)
+	http.HandleFunc("/map/wmts/", m.wmtsTile)
 	//http.Handle("/map/grids/", http.StripPrefix("/map/grids", http.FileServer(http.Dir(m.gridStorage))))
 
-	http.Handle("/map/", http.StripPrefix("/map", http.FileServer(http.Dir("frontend"))))
+	frontend := http.FileServer(http.FS(frontendFS))
+	public := http.FileServer(http.FS(publicFS))
+	if cfg.Dev {
+		frontend = noCache(frontend)
+		public = noCache(public)
+	}
+	http.Handle("/map/", http.StripPrefix("/map", frontend))
+
+	http.Handle("/js/", public)
 
-	http.Handle("/js/", http.FileServer(http.Dir("public")))
+	tlsConfig, redirect, err := setupTLS(cfg)
+	if err != nil {
+		fatal("Error setting up TLS", "error", err)
+	}
+
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", cfg.Port),
+		Handler:   requestID(m.withBasePath(m.instrument(http.DefaultServeMux))),
+		TLSConfig: tlsConfig,
+	}
+	// Update streams never finish on their own, end them so Shutdown only
+	// waits on real work like uploads.
+	srv.RegisterOnShutdown(func() {
+		m.gridUpdates.close()
+		m.mergeUpdates.close()
+	})
+
+	serveErr := make(chan error, 2)
+	go func() {
+		slog.Info("Listening", "port", cfg.Port, "tls", tlsConfig != nil)
+		if tlsConfig != nil {
+			serveErr <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	var redirectSrv *http.Server
+	if redirect != nil && cfg.HTTPPort != 0 {
+		redirectSrv = &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.HTTPPort),
+			Handler: redirect,
+		}
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "port", cfg.HTTPPort)
+			serveErr <- redirectSrv.ListenAndServe()
+		}()
+	}
 
-	log.Printf("Listening on port %d", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	select {
+	case err = <-serveErr:
+		fatal("Error serving", "error", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("Shutting down")
+	m.ready.Store(false)
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(sctx)
+	}
+	err = srv.Shutdown(sctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error shutting down, requests may have been cut off", "error", err)
+	}
+	select {
+	case <-zoomsDone:
+	case <-sctx.Done():
+		slog.Warn("Zoom workers did not stop in time")
+	}
+	m.flushStats()
+	err = db.Close()
+	if err != nil {
+		slog.Error("Error closing database", "error", err)
+	}
+	slog.Info("Shutdown complete")
 }
 
 type Character struct {
@@ -172,6 +355,12 @@ type GridData struct {
 	Coord      Coord
 	NextUpdate time.Time
 	Map        int
+
+	Creator    string
+	Uploader   string
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	LastUpload time.Time
 }
 
 type Coord struct {
@@ -220,9 +409,10 @@ const (
 )
 
 type User struct {
-	Pass   []byte
-	Auths  Auths
-	Tokens []string
+	Pass    []byte
+	Auths   Auths
+	Tokens  []string
+	APIKeys []string
 }
 
 func (m *Map) getSession(req *http.Request) *Session {
@@ -295,10 +485,13 @@ func (m *Map) saveSession(s *Session) {
 
 type Page struct {
 	Title string `json:"title"`
+	// Base is the base path with a trailing slash, links in templates are
+	// built on it.
+	Base string `json:"base"`
 }
 
 func (m *Map) getPage(req *http.Request) Page {
-	p := Page{}
+	p := Page{Base: m.cfg.BasePath}
 	m.db.View(func(tx *bbolt.Tx) error {
 		c := tx.Bucket([]byte("config"))
 		if c == nil {
@@ -310,6 +503,58 @@ func (m *Map) getPage(req *http.Request) Page {
 	return p
 }
 
+// redirect sends the client to path, given relative to the base path.
+func (m *Map) redirect(rw http.ResponseWriter, req *http.Request, path string) {
+	http.Redirect(rw, req, m.cfg.BasePath+strings.TrimPrefix(path, "/"), 302)
+}
+
+// withBasePath strips the base path before routing. Health checks are also
+// answered at the root so probes don't need to know the base path.
+func (m *Map) withBasePath(next http.Handler) http.Handler {
+	base := strings.TrimSuffix(m.cfg.BasePath, "/")
+	if base == "" {
+		return next
+	}
+	strip := http.StripPrefix(base, next)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == base:
+			http.Redirect(rw, req, base+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(req.URL.Path, base+"/"):
+			strip.ServeHTTP(&baseRedirects{ResponseWriter: rw, base: base}, req)
+		case req.URL.Path == "/healthz" || req.URL.Path == "/readyz":
+			next.ServeHTTP(rw, req)
+		default:
+			http.NotFound(rw, req)
+		}
+	})
+}
+
+// baseRedirects puts the base path in front of redirects to absolute paths
+// outside it, such as ServeMux adding a trailing slash.
+type baseRedirects struct {
+	http.ResponseWriter
+	base string
+}
+
+func (r *baseRedirects) WriteHeader(code int) {
+	loc := r.Header().Get("Location")
+	if strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") && !strings.HasPrefix(loc, r.base+"/") {
+		r.Header().Set("Location", r.base+loc)
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *baseRedirects) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *baseRedirects) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func (m *Map) getUser(user, pass string) (u *User) {
 	m.db.View(func(tx *bbolt.Tx) error {
 		users := tx.Bucket([]byte("users"))
@@ -334,11 +579,18 @@ func (m *Map) getUser(user, pass string) (u *User) {
 	return u
 }
 
-func (m *Map) cleanChars() {
-	for range time.Tick(time.Second * 10) {
+func (m *Map) cleanChars(ctx context.Context) {
+	t := time.NewTicker(m.cfg.CharacterTimeout.Duration)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
 		m.chmu.Lock()
 		for n, c := range m.characters {
-			if c.updated.Before(time.Now().Add(-10 * time.Second)) {
+			if c.updated.Before(time.Now().Add(-m.cfg.CharacterTimeout.Duration)) {
 				delete(m.characters, n)
 			}
 		}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -14,11 +15,12 @@ import (
 func (m *Map) index(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil {
-		http.Redirect(rw, req, "/login", 302)
+		m.redirect(rw, req, "/login")
 		return
 	}
 
 	tokens := []string{}
+	apiKeys := []string{}
 	prefix := "http://example.com"
 	m.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("users"))
@@ -32,6 +34,7 @@ func (m *Map) index(rw http.ResponseWriter, req *http.Request) {
 		u := User{}
 		json.Unmarshal(uRaw, &u)
 		tokens = u.Tokens
+		apiKeys = u.APIKeys
 
 		config := tx.Bucket([]byte("config"))
 		if config != nil {
@@ -40,15 +43,37 @@ func (m *Map) index(rw http.ResponseWriter, req *http.Request) {
 		return nil
 	})
 
+	type xyzMap struct {
+		Name string
+		Path string
+	}
+	xyzMaps := []xyzMap{}
+	if s.Auths.Has(AUTH_MAP) {
+		for _, e := range m.mapExtents() {
+			name := e.Name
+			if name == "" {
+				name = fmt.Sprintf("Map %d", e.ID)
+			}
+			xyzMaps = append(xyzMaps, xyzMap{
+				Name: name,
+				Path: fmt.Sprintf("map/xyz/%d/%s/{z}/{x}/{y}.png", e.ID, m.origin(e)),
+			})
+		}
+	}
+
 	m.ExecuteTemplate(rw, "index.tmpl", struct {
 		Page         Page
 		Session      *Session
 		UploadTokens []string
+		APIKeys      []string
+		XYZMaps      []xyzMap
 		Prefix       string
 	}{
 		Page:         m.getPage(req),
 		Session:      s,
 		UploadTokens: tokens,
+		APIKeys:      apiKeys,
+		XYZMaps:      xyzMaps,
 		Prefix:       prefix,
 	})
 }
@@ -63,6 +88,7 @@ func (m *Map) login(rw http.ResponseWriter, req *http.Request) {
 				Name:    "session",
 				Expires: time.Now().Add(time.Hour * 24 * 7),
 				Value:   hex.EncodeToString(session),
+				Path:    m.cfg.BasePath,
 			})
 			s := &Session{
 				ID:        hex.EncodeToString(session),
@@ -70,7 +96,7 @@ func (m *Map) login(rw http.ResponseWriter, req *http.Request) {
 				TempAdmin: u.Auths.Has("tempadmin"),
 			}
 			m.saveSession(s)
-			http.Redirect(rw, req, "/", 302)
+			m.redirect(rw, req, "/")
 			return
 		}
 	}
@@ -86,14 +112,14 @@ func (m *Map) logout(rw http.ResponseWriter, req *http.Request) {
 	if s != nil {
 		m.deleteSession(s)
 	}
-	http.Redirect(rw, req, "/login", 302)
+	m.redirect(rw, req, "/login")
 	return
 }
 
 func (m *Map) generateToken(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil || !s.Auths.Has(AUTH_UPLOAD) {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 	tokenRaw := make([]byte, 16)
@@ -132,13 +158,61 @@ func (m *Map) generateToken(rw http.ResponseWriter, req *http.Request) {
 		}
 		return b.Put([]byte(token), []byte(s.Username))
 	})
-	http.Redirect(rw, req, "/", 302)
+	m.redirect(rw, req, "/")
+}
+
+// generateAPIKey creates a read only key for the XYZ and WMTS endpoints.
+// Keys are kept apart from upload tokens, so handing one to a GIS tool can't
+// be used to upload.
+func (m *Map) generateAPIKey(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_MAP) {
+		m.redirect(rw, req, "/")
+		return
+	}
+	keyRaw := make([]byte, 16)
+	_, err := rand.Read(keyRaw)
+	if err != nil {
+		rw.WriteHeader(500)
+		return
+	}
+	key := hex.EncodeToString(keyRaw)
+	m.db.Update(func(tx *bbolt.Tx) error {
+		ub, err := tx.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return err
+		}
+		uRaw := ub.Get([]byte(s.Username))
+		if uRaw == nil {
+			return nil
+		}
+		u := User{}
+		err = json.Unmarshal(uRaw, &u)
+		if err != nil {
+			return err
+		}
+		u.APIKeys = append(u.APIKeys, key)
+		buf, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		err = ub.Put([]byte(s.Username), buf)
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte("apikeys"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(s.Username))
+	})
+	m.redirect(rw, req, "/")
 }
 
 func (m *Map) changePassword(rw http.ResponseWriter, req *http.Request) {
 	s := m.getSession(req)
 	if s == nil {
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 		return
 	}
 
@@ -162,7 +236,7 @@ func (m *Map) changePassword(rw http.ResponseWriter, req *http.Request) {
 			users.Put([]byte(s.Username), raw)
 			return nil
 		})
-		http.Redirect(rw, req, "/", 302)
+		m.redirect(rw, req, "/")
 	}
 
 	m.ExecuteTemplate(rw, "password.tmpl", struct {
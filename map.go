@@ -9,8 +9,10 @@ import (
 )
 
 type Config struct {
-	Title string   `json:"title"`
-	Auths []string `json:"auths"`
+	Title      string   `json:"title"`
+	Auths      []string `json:"auths"`
+	TileSize   int      `json:"tileSize"`
+	ZoomLevels int      `json:"zoomLevels"`
 }
 
 func (m *Map) getChars(rw http.ResponseWriter, req *http.Request) {
@@ -42,6 +44,11 @@ func (m *Map) getMarkers(rw http.ResponseWriter, req *http.Request) {
 		json.NewEncoder(rw).Encode([]interface{}{})
 		return
 	}
+	json.NewEncoder(rw).Encode(m.frontendMarkers())
+}
+
+// frontendMarkers returns every marker, positioned on its map.
+func (m *Map) frontendMarkers() []FrontendMarker {
 	markers := []FrontendMarker{}
 	m.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("markers"))
@@ -79,7 +86,37 @@ func (m *Map) getMarkers(rw http.ResponseWriter, req *http.Request) {
 			return nil
 		})
 	})
-	json.NewEncoder(rw).Encode(markers)
+	return markers
+}
+
+func (m *Map) tileInfo(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_MAP) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	mapid, err := strconv.Atoi(req.FormValue("map"))
+	if err != nil {
+		http.Error(rw, "coord parse failed", http.StatusBadRequest)
+		return
+	}
+	x, err := strconv.Atoi(req.FormValue("x"))
+	if err != nil {
+		http.Error(rw, "coord parse failed", http.StatusBadRequest)
+		return
+	}
+	y, err := strconv.Atoi(req.FormValue("y"))
+	if err != nil {
+		http.Error(rw, "coord parse failed", http.StatusBadRequest)
+		return
+	}
+	c := Coord{X: x, Y: y}
+	info := []GridData{}
+	m.db.View(func(tx *bbolt.Tx) error {
+		info = gridsAt(tx, mapid, c)
+		return nil
+	})
+	json.NewEncoder(rw).Encode(info)
 }
 
 func (m *Map) getMaps(rw http.ResponseWriter, req *http.Request) {
@@ -118,7 +155,9 @@ func (m *Map) config(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	config := Config{
-		Auths: s.Auths,
+		Auths:      s.Auths,
+		TileSize:   tileSize,
+		ZoomLevels: m.cfg.ZoomLevels,
 	}
 	m.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("config"))
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hnhmap_http_requests_total",
+		Help: "HTTP requests by route and status code.",
+	}, []string{"route", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hnhmap_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	tileUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hnhmap_tile_uploads_total",
+		Help: "Tile uploads by result (accepted, unchanged, winter, nextupdate).",
+	}, []string{"result"})
+	zoomDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hnhmap_zoom_update_duration_seconds",
+		Help:    "Time taken to regenerate a single zoom tile.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"zoom"})
+	sseSubscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hnhmap_sse_subscribers",
+		Help: "Connected update stream subscribers.",
+	}, []string{"topic"})
+	sseDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hnhmap_sse_dropped_subscribers_total",
+		Help: "Update stream subscribers dropped for not keeping up.",
+	}, []string{"topic"})
+)
+
+var clientActions = map[string]bool{
+	"":               true,
+	"locate":         true,
+	"gridUpdate":     true,
+	"gridUpload":     true,
+	"positionUpdate": true,
+	"markerUpdate":   true,
+	"checkVersion":   true,
+}
+
+func (m *Map) registerMetrics() {
+	prometheus.MustRegister(httpRequests, httpDuration, tileUploads, zoomDuration, sseSubscribers, sseDropped)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "hnhmap_characters",
+		Help: "Characters currently tracked.",
+	}, func() float64 {
+		m.chmu.RLock()
+		defer m.chmu.RUnlock()
+		return float64(len(m.characters))
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "hnhmap_zoom_queue",
+		Help: "Zoom tiles waiting to be regenerated.",
+	}, func() float64 {
+		return float64(m.zoomQueueDepth())
+	}))
+	prometheus.MustRegister(&boltCollector{m: m})
+}
+
+type boltCollector struct {
+	m *Map
+}
+
+var (
+	boltTxDesc        = prometheus.NewDesc("hnhmap_bolt_tx_total", "Read transactions started.", nil, nil)
+	boltOpenTxDesc    = prometheus.NewDesc("hnhmap_bolt_open_tx", "Open read transactions.", nil, nil)
+	boltFreePageDesc  = prometheus.NewDesc("hnhmap_bolt_free_pages", "Free pages on the freelist.", nil, nil)
+	boltPendingDesc   = prometheus.NewDesc("hnhmap_bolt_pending_pages", "Pending pages on the freelist.", nil, nil)
+	boltFreeAllocDesc = prometheus.NewDesc("hnhmap_bolt_free_alloc_bytes", "Bytes allocated in free pages.", nil, nil)
+	boltWriteDesc     = prometheus.NewDesc("hnhmap_bolt_write_seconds_total", "Time spent writing to disk.", nil, nil)
+)
+
+func (c *boltCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- boltTxDesc
+	ch <- boltOpenTxDesc
+	ch <- boltFreePageDesc
+	ch <- boltPendingDesc
+	ch <- boltFreeAllocDesc
+	ch <- boltWriteDesc
+}
+
+func (c *boltCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.m.db.Stats()
+	ch <- prometheus.MustNewConstMetric(boltTxDesc, prometheus.CounterValue, float64(st.TxN))
+	ch <- prometheus.MustNewConstMetric(boltOpenTxDesc, prometheus.GaugeValue, float64(st.OpenTxN))
+	ch <- prometheus.MustNewConstMetric(boltFreePageDesc, prometheus.GaugeValue, float64(st.FreePageN))
+	ch <- prometheus.MustNewConstMetric(boltPendingDesc, prometheus.GaugeValue, float64(st.PendingPageN))
+	ch <- prometheus.MustNewConstMetric(boltFreeAllocDesc, prometheus.GaugeValue, float64(st.FreeAlloc))
+	ch <- prometheus.MustNewConstMetric(boltWriteDesc, prometheus.CounterValue, st.TxStats.WriteTime.Seconds())
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, for deadlines on
+// streamed responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument records request counts and latency, labelled by the mux
+// pattern that serves the request. Client requests are further split by
+// action.
+func (m *Map) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, route := mux.Handler(req)
+		if route == "/client/" {
+			action := "other"
+			if matches := clientPath.FindStringSubmatch(req.URL.Path); matches != nil && clientActions[matches[2]] {
+				action = matches[2]
+			}
+			route += action
+		}
+		rec := &statusRecorder{ResponseWriter: rw, code: 200}
+		start := time.Now()
+		mux.ServeHTTP(rec, req)
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, strconv.Itoa(rec.code)).Inc()
+	})
+}
+
+// metricsHandler serves /metrics to clients inside the allowed networks.
+func metricsHandler(allow string) (http.Handler, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range strings.Split(allow, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	h := promhttp.Handler()
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ip := net.ParseIP(remoteIP(req))
+		for _, n := range nets {
+			if ip != nil && n.Contains(ip) {
+				h.ServeHTTP(rw, req)
+				return
+			}
+		}
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+	}), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInstrumentKeepsResponseController(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/map/updates", func(rw http.ResponseWriter, req *http.Request) {
+		rc := http.NewResponseController(rw)
+		err := rc.SetWriteDeadline(time.Now().Add(time.Minute))
+		if err != nil {
+			t.Errorf("SetWriteDeadline: %v", err)
+		}
+		err = rc.Flush()
+		if err != nil {
+			t.Errorf("Flush: %v", err)
+		}
+	})
+	m := &Map{}
+	srv := httptest.NewServer(m.instrument(mux))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/map/updates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
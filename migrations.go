@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/andyleap/hnh-map/tilestore"
+
 	"go.etcd.io/bbolt"
 )
 
@@ -175,4 +178,87 @@ var migrations = []func(tx *bbolt.Tx) error{
 			return nil
 		})
 	},
+	reindexGrids,
+}
+
+// migrateTileStore moves the tile images over when tile_store is switched,
+// and records the store in use. Servers from before the setting existed kept
+// their images in files.
+func (m *Map) migrateTileStore() error {
+	prev := "file"
+	m.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket([]byte("config")).Get([]byte("tileStore")); v != nil {
+			prev = string(v)
+		}
+		return nil
+	})
+	cur := m.cfg.TileStore
+	if prev != cur {
+		// The s3 settings are shared, so moving away from s3 needs them
+		// kept until the move is done
+		prevCfg := m.cfg
+		prevCfg.TileStore = prev
+		if prev == "s3" && (prevCfg.S3Endpoint == "" || prevCfg.S3Bucket == "") {
+			return fmt.Errorf("tile images are in s3, keep the s3 settings until they have been moved to the %s store", cur)
+		}
+		from, err := prevCfg.tileStore(m.db)
+		if err != nil {
+			return err
+		}
+		names := []string{}
+		err = from.Walk("", func(name string, size int64) error {
+			if strings.HasSuffix(name, ".png") && !strings.HasPrefix(name, "historycache/") {
+				names = append(names, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		slog.Info("Moving tile images", "from", prev, "to", cur, "files", len(names))
+
+		// Nothing is removed until everything is copied, so an interrupted
+		// move just starts over
+		err = m.copyTiles(from, names)
+		if err != nil {
+			return err
+		}
+
+		if prev == "bolt" {
+			err = m.db.Update(func(tx *bbolt.Tx) error {
+				return tx.DeleteBucket([]byte("tilestore"))
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			for _, name := range names {
+				from.Remove(name)
+			}
+		}
+	}
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("config")).Put([]byte("tileStore"), []byte(cur))
+	})
+}
+
+// copyTiles copies images into the tile store without syncing the database
+// after every image.
+func (m *Map) copyTiles(from tilestore.Store, names []string) error {
+	m.db.NoSync = true
+	defer func() {
+		m.db.NoSync = false
+	}()
+	for _, name := range names {
+		f, err := from.Open(name)
+		if err != nil {
+			return err
+		}
+		err = m.tiles.Put(name, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return m.db.Sync()
 }
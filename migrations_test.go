@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andyleap/hnh-map/tilestore"
+	"go.etcd.io/bbolt"
+)
+
+func tileStoreMap(t *testing.T, dir string, store, prev string) *Map {
+	t.Helper()
+	db, err := bbolt.Open(filepath.Join(dir, "grids.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = db.Update(func(tx *bbolt.Tx) error {
+		config, err := tx.CreateBucketIfNotExists([]byte("config"))
+		if err != nil {
+			return err
+		}
+		return config.Put([]byte("tileStore"), []byte(prev))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.GridStorage = dir
+	cfg.TileStore = store
+	tiles, err := cfg.tileStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Map{gridStorage: dir, db: db, cfg: cfg, tiles: tiles}
+}
+
+func TestMigrateTileStore(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "blobs", "ab"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "blobs", "ab", "abcd.png"), []byte("image"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := tileStoreMap(t, dir, "bolt", "file")
+	err = m.migrateTileStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := m.tiles.Open("blobs/ab/abcd.png")
+	if err != nil {
+		t.Fatalf("image not moved to bolt: %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "image" {
+		t.Errorf("moved image has %q", data)
+	}
+	_, err = os.Stat(filepath.Join(dir, "blobs", "ab", "abcd.png"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("image left in the grids directory: %v", err)
+	}
+	_, err = tilestore.NewFS(dir).Open("blobs/ab/abcd.png")
+	if !errors.Is(err, tilestore.ErrNotExist) {
+		t.Errorf("image still in the file store: %v", err)
+	}
+}
+
+func TestMigrateTileStoreFromS3WithoutSettings(t *testing.T) {
+	m := tileStoreMap(t, t.TempDir(), "file", "s3")
+	err := m.migrateTileStore()
+	if err == nil || !strings.Contains(err.Error(), "s3") {
+		t.Fatalf("got %v, want an error asking for the s3 settings", err)
+	}
+	stored := ""
+	m.db.View(func(tx *bbolt.Tx) error {
+		stored = string(tx.Bucket([]byte("config")).Get([]byte("tileStore")))
+		return nil
+	})
+	if stored != "s3" {
+		t.Errorf("recorded tile store %q, want s3 until the images are moved", stored)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// renderImage is a region of a map stitched from its tiles. It is rendered
+// one row of tiles at a time as the PNG encoder reads it top to bottom, so
+// large images are streamed without being held in memory.
+type renderImage struct {
+	m       *Map
+	mapid   int
+	z       int
+	min     Coord // top left tile
+	w, h    int   // in tiles
+	grid    bool
+	markers []FrontendMarker
+	scaler  draw.Scaler
+
+	row   int
+	strip *image.NRGBA
+}
+
+func (r *renderImage) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (r *renderImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, r.w*tileSize, r.h*tileSize)
+}
+
+func (r *renderImage) At(x, y int) color.Color {
+	row := y / tileSize
+	if r.strip == nil || row != r.row {
+		r.renderRow(row)
+	}
+	return r.strip.NRGBAAt(x, y)
+}
+
+// Opaque stops the PNG encoder from scanning every pixel up front to check,
+// which would render the whole image an extra time. Unexplored areas are
+// transparent anyway.
+func (r *renderImage) Opaque() bool {
+	return false
+}
+
+// renderRow draws a row of tiles into the strip, which covers the image
+// rows of that tile row.
+func (r *renderImage) renderRow(row int) {
+	r.row = row
+	if r.strip == nil {
+		r.strip = image.NewNRGBA(image.Rect(0, 0, r.w*tileSize, tileSize))
+	}
+	r.strip.Rect = image.Rect(0, row*tileSize, r.w*tileSize, (row+1)*tileSize)
+	draw.Draw(r.strip, r.strip.Rect, image.Transparent, image.Point{}, draw.Src)
+
+	for col := 0; col < r.w; col++ {
+		td := r.m.GetTile(r.mapid, Coord{X: r.min.X + col, Y: r.min.Y + row}, r.z)
+		if td == nil || td.File == "" {
+			continue
+		}
+		img, err := decodeTile(r.m.tiles, td.File)
+		if err != nil {
+			continue
+		}
+		dr := image.Rect(col*tileSize, row*tileSize, (col+1)*tileSize, (row+1)*tileSize)
+		if img.Bounds().Size() == dr.Size() {
+			draw.Draw(r.strip, dr, img, img.Bounds().Min, draw.Src)
+		} else {
+			r.scaler.Scale(r.strip, dr, img, img.Bounds(), draw.Src, nil)
+		}
+	}
+
+	if r.grid {
+		line := image.NewUniform(color.NRGBA{A: 0x80})
+		d := &font.Drawer{Dst: r.strip, Src: image.Black, Face: basicfont.Face7x13}
+		for col := 0; col < r.w; col++ {
+			x, y := col*tileSize, row*tileSize
+			draw.Draw(r.strip, image.Rect(x, y, x+tileSize, y+1), line, image.Point{}, draw.Over)
+			draw.Draw(r.strip, image.Rect(x, y+1, x+1, y+tileSize), line, image.Point{}, draw.Over)
+			// Labelled with the top left grid, like the map's coordinate layer
+			d.Dot = fixed.P(x+3, y+14)
+			d.DrawString(fmt.Sprintf("(%d;%d)", (r.min.X+col)<<r.z, (r.min.Y+row)<<r.z))
+		}
+	}
+
+	const radius = 4
+	for _, mk := range r.markers {
+		// Marker positions are in game units, 100 to a grid
+		px := mk.Position.X>>r.z - r.min.X*tileSize
+		py := mk.Position.Y>>r.z - r.min.Y*tileSize
+		if py+radius < row*tileSize || py-radius >= (row+1)*tileSize {
+			continue
+		}
+		for dy := -radius; dy <= radius; dy++ {
+			for dx := -radius; dx <= radius; dx++ {
+				dd := dx*dx + dy*dy
+				switch {
+				case dd <= (radius-1)*(radius-1):
+					r.strip.Set(px+dx, py+dy, color.NRGBA{R: 0xe0, G: 0x20, B: 0x20, A: 0xff})
+				case dd <= radius*radius:
+					r.strip.Set(px+dx, py+dy, color.Black)
+				}
+			}
+		}
+	}
+}
+
+// render serves a PNG of the tiles of a map covering the grids x1,y1 to
+// x2,y2 at zoom level zoom, optionally with markers and grid coordinates.
+func (m *Map) render(rw http.ResponseWriter, req *http.Request) {
+	auths := m.apiAuths(req)
+	if !auths.Has(AUTH_MAP) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	params := map[string]int{}
+	for _, p := range []string{"map", "x1", "y1", "x2", "y2", "zoom"} {
+		v, err := strconv.Atoi(req.FormValue(p))
+		if err != nil && !(p == "zoom" && req.FormValue(p) == "") {
+			http.Error(rw, p+" parse failed", http.StatusBadRequest)
+			return
+		}
+		params[p] = v
+	}
+	z := params["zoom"]
+	if z < 0 || z > m.cfg.ZoomLevels {
+		http.Error(rw, fmt.Sprintf("zoom must be between 0 and %d", m.cfg.ZoomLevels), http.StatusBadRequest)
+		return
+	}
+	// Tiles at zoom z cover 2^z grids a side
+	x1, x2 := min(params["x1"], params["x2"]), max(params["x1"], params["x2"])
+	y1, y2 := min(params["y1"], params["y2"]), max(params["y1"], params["y2"])
+	r := &renderImage{
+		m:      m,
+		mapid:  params["map"],
+		z:      z,
+		min:    Coord{X: x1 >> z, Y: y1 >> z},
+		w:      x2>>z - x1>>z + 1,
+		h:      y2>>z - y1>>z + 1,
+		grid:   req.FormValue("grid") != "",
+		scaler: m.resampler(),
+	}
+	// Compared in tiles, so absurd coords can't overflow the pixel size
+	limit := m.cfg.MaxRenderSize / tileSize
+	if r.w <= 0 || r.h <= 0 || r.w > limit || r.h > limit {
+		http.Error(rw, fmt.Sprintf("image is limited to %dx%d tiles of %d pixels at this zoom, zoom out or pick a smaller area",
+			limit, limit, tileSize), http.StatusBadRequest)
+		return
+	}
+	if req.FormValue("markers") != "" && auths.Has(AUTH_MARKERS) {
+		for _, mk := range m.frontendMarkers() {
+			if mk.Map == r.mapid && !mk.Hidden {
+				r.markers = append(r.markers, mk)
+			}
+		}
+	}
+
+	rw.Header().Set("Content-Type", "image/png")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"map-%d.png\"", r.mapid))
+	rw.Header().Set("Cache-Control", "private, no-cache")
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	err := enc.Encode(rw, r)
+	if err != nil {
+		logger(req).Warn("Error rendering map", "error", err)
+	}
+}
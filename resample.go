@@ -0,0 +1,130 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/image/draw"
+)
+
+// Resamplers scale child tiles into zoom tiles. mode picks the most common
+// colour of each block of source pixels, which keeps terrain colours
+// distinct where the others blend them.
+var resamplers = map[string]draw.Scaler{
+	"nearest":    draw.NearestNeighbor,
+	"bilinear":   draw.BiLinear,
+	"catmullrom": draw.CatmullRom,
+	"mode":       modeScaler{},
+}
+
+var resampleNames = []string{"bilinear", "nearest", "catmullrom", "mode"}
+
+const defaultResample = "bilinear"
+
+func (m *Map) getResample() string {
+	name := defaultResample
+	m.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte("config"))
+		if c == nil {
+			return nil
+		}
+		if v := string(c.Get([]byte("resample"))); resamplers[v] != nil {
+			name = v
+		}
+		return nil
+	})
+	return name
+}
+
+func (m *Map) resampler() draw.Scaler {
+	return resamplers[m.getResample()]
+}
+
+// modeScaler always replaces the destination pixels, whatever op is.
+type modeScaler struct{}
+
+func (modeScaler) Scale(dst draw.Image, dr image.Rectangle, src image.Image, sr image.Rectangle, op draw.Op, opts *draw.Options) {
+	if dr.Empty() || sr.Empty() {
+		return
+	}
+	counts := map[color.NRGBA]int{}
+	for y := dr.Min.Y; y < dr.Max.Y; y++ {
+		sy0 := sr.Min.Y + (y-dr.Min.Y)*sr.Dy()/dr.Dy()
+		sy1 := sr.Min.Y + (y-dr.Min.Y+1)*sr.Dy()/dr.Dy()
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := dr.Min.X; x < dr.Max.X; x++ {
+			sx0 := sr.Min.X + (x-dr.Min.X)*sr.Dx()/dr.Dx()
+			sx1 := sr.Min.X + (x-dr.Min.X+1)*sr.Dx()/dr.Dx()
+			if sx1 == sx0 {
+				sx1++
+			}
+			clear(counts)
+			best, bestN := color.NRGBA{}, 0
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					c := color.NRGBAModel.Convert(src.At(sx, sy)).(color.NRGBA)
+					counts[c]++
+					// Ties go to the colour that reached the count first
+					if counts[c] > bestN {
+						best, bestN = c, counts[c]
+					}
+				}
+			}
+			dst.Set(x, y, best)
+		}
+	}
+}
+
+func (m *Map) setResample(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
+		m.redirect(rw, req, "/")
+		return
+	}
+	resample := req.FormValue("resample")
+	if resamplers[resample] == nil {
+		http.Error(rw, "unknown resampling", http.StatusBadRequest)
+		return
+	}
+	rebuild := req.FormValue("rebuild") != ""
+	m.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("config"))
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte("resample"), []byte(resample))
+		if err != nil {
+			return err
+		}
+		if !rebuild {
+			return nil
+		}
+		tiles := tx.Bucket([]byte("tiles"))
+		if tiles == nil {
+			return nil
+		}
+		return tiles.ForEach(func(k, v []byte) error {
+			mapb := tiles.Bucket(k)
+			if mapb == nil {
+				return nil
+			}
+			mapid, _ := strconv.Atoi(string(k))
+			return queueZoomLevel(tx, mapb, mapid, 0)
+		})
+	})
+	m.audit(req, s, "setResample", 0, nil, map[string]string{
+		"resample": resample,
+		"rebuild":  strconv.FormatBool(rebuild),
+	})
+	// Cached historic tiles were scaled the old way
+	m.cache.RemoveAll(historicCachePrefix)
+	if rebuild {
+		m.zooms.notify()
+	}
+	m.redirect(rw, req, "/admin/")
+}
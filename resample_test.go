@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+var update = flag.Bool("update", false, "rewrite golden images in testdata")
+
+// resampleInput is a fixed tile with flat terrain-like areas, a one pixel
+// line and a gradient, the features the filters treat differently.
+func resampleInput() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	grass := color.NRGBA{R: 0x4c, G: 0x8a, B: 0x2f, A: 0xff}
+	water := color.NRGBA{R: 0x2a, G: 0x4f, B: 0x9c, A: 0xff}
+	sand := color.NRGBA{R: 0xd8, G: 0xc4, B: 0x7a, A: 0xff}
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			var c color.NRGBA
+			switch {
+			case y < 50 && x < 50:
+				// Speckled grass, mostly grass with a few sand pixels
+				c = grass
+				if (x*7+y*13)%5 == 0 {
+					c = sand
+				}
+			case y < 50:
+				c = water
+			case x < 50:
+				c = color.NRGBA{R: uint8(x * 5), G: uint8(y * 2), B: 0x80, A: 0xff}
+			default:
+				c = sand
+			}
+			if x == 75 {
+				c = color.NRGBA{A: 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestResampleGolden(t *testing.T) {
+	src := resampleInput()
+	for _, name := range resampleNames {
+		t.Run(name, func(t *testing.T) {
+			got := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+			draw.Draw(got, got.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			drawQuadrant(got, 1, 0, src, resamplers[name])
+			got = got.SubImage(image.Rect(tileSize/2, 0, tileSize, tileSize/2)).(*image.NRGBA)
+
+			golden := filepath.Join("testdata", "resample", name+".png")
+			if *update {
+				os.MkdirAll(filepath.Dir(golden), 0777)
+				f, err := os.Create(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				err = png.Encode(f, got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			f, err := os.Open(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			want, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Bounds().Size() != want.Bounds().Size() {
+				t.Fatalf("got %v, golden image is %v", got.Bounds().Size(), want.Bounds().Size())
+			}
+			diffs := 0
+			for y := 0; y < want.Bounds().Dy(); y++ {
+				for x := 0; x < want.Bounds().Dx(); x++ {
+					g := got.NRGBAAt(got.Rect.Min.X+x, got.Rect.Min.Y+y)
+					w := color.NRGBAModel.Convert(want.At(want.Bounds().Min.X+x, want.Bounds().Min.Y+y)).(color.NRGBA)
+					// Allow for floating point differences between platforms
+					if absDiff(g.R, w.R) > 1 || absDiff(g.G, w.G) > 1 || absDiff(g.B, w.B) > 1 || absDiff(g.A, w.A) > 1 {
+						if diffs == 0 {
+							t.Errorf("first difference at %d,%d: got %v, want %v", x, y, g, w)
+						}
+						diffs++
+					}
+				}
+			}
+			if diffs > 0 {
+				t.Errorf("%d pixels differ from %s, run go test -update if the change is intended", diffs, golden)
+			}
+		})
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestModeScaler(t *testing.T) {
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	blue := color.NRGBA{B: 0xff, A: 0xff}
+	green := color.NRGBA{G: 0xff, A: 0xff}
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	// Left block is mostly blue, right block is a tie between red and green
+	for _, p := range []struct {
+		x, y int
+		c    color.NRGBA
+	}{
+		{0, 0, red}, {1, 0, blue}, {0, 1, blue}, {1, 1, blue},
+		{2, 0, red}, {3, 0, green}, {2, 1, red}, {3, 1, green},
+	} {
+		src.SetNRGBA(p.x, p.y, p.c)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	modeScaler{}.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	if got := dst.NRGBAAt(0, 0); got != blue {
+		t.Errorf("left pixel %v, want the majority colour %v", got, blue)
+	}
+	if got := dst.NRGBAAt(1, 0); got != red {
+		t.Errorf("right pixel %v, want the tied colour counted first %v", got, red)
+	}
+}
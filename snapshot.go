@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const maxSnapshots = 20
+
+// Snapshot holds the grid and zoom 0 tile records of a map as they were
+// before a destructive operation, so the operation can be reverted.
+type Snapshot struct {
+	ID     uint64
+	Time   time.Time
+	User   string
+	Action string
+	Map    int
+	Grids  []GridData
+	Tiles  []TileData
+	// ReplaceTiles drops every tile of the map on revert instead of only
+	// restoring the saved ones.
+	ReplaceTiles bool
+}
+
+// saveSnapshot stores s inside the transaction performing the operation, and
+// drops the oldest snapshots beyond maxSnapshots. Snapshots hold on to their
+// tile images until they are dropped or reverted.
+func saveSnapshot(tx *bbolt.Tx, s *Snapshot) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("snapshots"))
+	if err != nil {
+		return err
+	}
+	s.ID, err = b.NextSequence()
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = b.Put([]byte(fmt.Sprintf("%020d", s.ID)), raw)
+	if err != nil {
+		return err
+	}
+	for _, td := range s.Tiles {
+		err = retainBlob(tx, td.File)
+		if err != nil {
+			return err
+		}
+	}
+	n := 0
+	b.ForEach(func(k, v []byte) error {
+		n++
+		return nil
+	})
+	c := b.Cursor()
+	for ; n > maxSnapshots; n-- {
+		k, v := c.First()
+		if k == nil {
+			break
+		}
+		err = releaseSnapshot(tx, v)
+		if err != nil {
+			return err
+		}
+		err = c.Delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func releaseSnapshot(tx *bbolt.Tx, raw []byte) error {
+	s := Snapshot{}
+	json.Unmarshal(raw, &s)
+	for _, td := range s.Tiles {
+		err := releaseBlob(tx, td.File)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type SnapshotSummary struct {
+	ID     uint64
+	Time   time.Time
+	User   string
+	Action string
+	Map    int
+}
+
+func (m *Map) getSnapshots() []SnapshotSummary {
+	snaps := []SnapshotSummary{}
+	m.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("snapshots"))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			s := SnapshotSummary{}
+			json.Unmarshal(v, &s)
+			snaps = append(snaps, s)
+		}
+		return nil
+	})
+	return snaps
+}
+
+var errSnapshotConflict = errors.New("grid has been uploaded since")
+
+// revertSnapshots restores the newest count snapshots, newest first, and
+// returns the restored snapshots. Nothing is reverted if a grid to restore
+// would land on a coord another grid has taken since, or if a snapshot
+// replacing the map's tiles would drop the tiles of grids uploaded since.
+func (m *Map) revertSnapshots(count int) ([]Snapshot, error) {
+	reverted := []Snapshot{}
+	// Tiles to restore per map, older snapshots after newer ones so the
+	// oldest state wins
+	tds := map[int][]TileData{}
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("snapshots"))
+		if b == nil {
+			return nil
+		}
+		grids, err := tx.CreateBucketIfNotExists([]byte("grids"))
+		if err != nil {
+			return err
+		}
+		tiles, err := tx.CreateBucketIfNotExists([]byte("tiles"))
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(reverted) < count; k, v = c.Last() {
+			s := Snapshot{}
+			err := json.Unmarshal(v, &s)
+			if err != nil {
+				return err
+			}
+			err = checkSnapshotGrids(tx, &s)
+			if err != nil {
+				return err
+			}
+			for _, g := range s.Grids {
+				raw, err := json.Marshal(g)
+				if err != nil {
+					return err
+				}
+				err = grids.Put([]byte(g.ID), raw)
+				if err != nil {
+					return err
+				}
+			}
+			if mapb := tiles.Bucket([]byte(strconv.Itoa(s.Map))); s.ReplaceTiles && mapb != nil {
+				err = releaseTiles(tx, mapb)
+				if err != nil {
+					return err
+				}
+				err = tiles.DeleteBucket([]byte(strconv.Itoa(s.Map)))
+				if err != nil {
+					return err
+				}
+			}
+			if s.ReplaceTiles {
+				// Tiles restored by newer snapshots are part of the map
+				// being replaced
+				delete(tds, s.Map)
+			}
+			tds[s.Map] = append(tds[s.Map], s.Tiles...)
+			err = releaseSnapshot(tx, v)
+			if err != nil {
+				return err
+			}
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+			// The next snapshot is checked against the grids as this one
+			// left them
+			err = reindexGrids(tx)
+			if err != nil {
+				return err
+			}
+			reverted = append(reverted, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	needProcess := map[zoomproc]struct{}{}
+	for _, mtds := range tds {
+		for _, td := range mtds {
+			m.SaveTile(td.MapID, td.Coord, td.Zoom, td.File, time.Now().UnixNano())
+			needProcess[zoomproc{c: td.Coord.Parent(), m: td.MapID}] = struct{}{}
+		}
+	}
+	m.updateZooms(needProcess)
+	return reverted, nil
+}
+
+// checkSnapshotGrids fails with errSnapshotConflict if a grid of s would be
+// restored onto a coord held by a grid that isn't part of s, or if s replaces
+// the map's tiles and the map has a grid that isn't part of s.
+func checkSnapshotGrids(tx *bbolt.Tx, s *Snapshot) error {
+	restored := map[string]bool{}
+	for _, g := range s.Grids {
+		restored[g.ID] = true
+	}
+	type pos struct {
+		m int
+		c Coord
+	}
+	taken := map[pos]string{}
+	for _, g := range mapGrids(tx, s.Map) {
+		if restored[g.ID] {
+			continue
+		}
+		if s.ReplaceTiles {
+			return fmt.Errorf("%w: snapshot %d would drop the tile of grid %s on %s",
+				errSnapshotConflict, s.ID, g.ID, g.Coord.Name())
+		}
+		taken[pos{g.Map, g.Coord}] = g.ID
+	}
+	for _, g := range s.Grids {
+		if id, ok := taken[pos{g.Map, g.Coord}]; ok {
+			return fmt.Errorf("%w: snapshot %d would put grid %s on %s, which holds grid %s",
+				errSnapshotConflict, s.ID, g.ID, g.Coord.Name(), id)
+		}
+	}
+	return nil
+}
+
+func (m *Map) revert(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
+		m.redirect(rw, req, "/")
+		return
+	}
+	count, err := strconv.Atoi(req.FormValue("count"))
+	if err != nil || count <= 0 {
+		http.Error(rw, "count parse failed", http.StatusBadRequest)
+		return
+	}
+	reverted, err := m.revertSnapshots(count)
+	if errors.Is(err, errSnapshotConflict) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger(req).Error("Error reverting snapshots", "error", err)
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+		return
+	}
+	for _, snap := range reverted {
+		m.clearHistoricCache(snap.Map)
+		m.audit(req, s, "revert", snap.Map, nil, map[string]string{
+			"snapshot": strconv.FormatUint(snap.ID, 10),
+			"action":   snap.Action,
+			"by":       snap.User,
+		})
+	}
+	m.redirect(rw, req, "/admin/")
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+type UploadStats struct {
+	Grids        int       `json:"grids"`
+	Tiles        int       `json:"tiles"`
+	Markers      int       `json:"markers"`
+	Positions    int       `json:"positions"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+func (s *UploadStats) add(d UploadStats) {
+	s.Grids += d.Grids
+	s.Tiles += d.Tiles
+	s.Markers += d.Markers
+	s.Positions += d.Positions
+	if d.LastActivity.After(s.LastActivity) {
+		s.LastActivity = d.LastActivity
+	}
+}
+
+type TokenStats struct {
+	User         string    `json:"user"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+func addStatsTo(b *bbolt.Bucket, key string, d UploadStats) error {
+	st := UploadStats{}
+	if raw := b.Get([]byte(key)); raw != nil {
+		json.Unmarshal(raw, &st)
+	}
+	st.add(d)
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), raw)
+}
+
+// pendingStats collects counts in memory until they are flushed, as
+// position updates alone arrive every few seconds from every client.
+type pendingStats struct {
+	mu     sync.Mutex
+	users  map[string]UploadStats
+	maps   map[int]map[string]UploadStats
+	tokens map[string]TokenStats
+}
+
+const statsFlushInterval = 10 * time.Second
+
+// addStats counts the work done by the client making req. deltas is keyed by
+// map ID, key 0 only counts towards the user totals.
+func (m *Map) addStats(req *http.Request, deltas map[int]UploadStats) {
+	user := requestUser(req)
+	token := requestToken(req)
+	if user == "" {
+		return
+	}
+	now := time.Now()
+	p := &m.stats
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.users == nil {
+		p.users = map[string]UploadStats{}
+		p.maps = map[int]map[string]UploadStats{}
+		p.tokens = map[string]TokenStats{}
+	}
+	total := UploadStats{LastActivity: now}
+	for mapid, d := range deltas {
+		d.LastActivity = now
+		total.add(d)
+		if mapid == 0 {
+			continue
+		}
+		if p.maps[mapid] == nil {
+			p.maps[mapid] = map[string]UploadStats{}
+		}
+		st := p.maps[mapid][user]
+		st.add(d)
+		p.maps[mapid][user] = st
+	}
+	st := p.users[user]
+	st.add(total)
+	p.users[user] = st
+	if token != "" {
+		p.tokens[token] = TokenStats{User: user, LastActivity: now}
+	}
+}
+
+// flushStats adds the counts collected since the last flush to the stats
+// bucket.
+func (m *Map) flushStats() {
+	p := &m.stats
+	p.mu.Lock()
+	users, maps, tokens := p.users, p.maps, p.tokens
+	p.users, p.maps, p.tokens = nil, nil, nil
+	p.mu.Unlock()
+	if len(users) == 0 {
+		return
+	}
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		stats, err := tx.CreateBucketIfNotExists([]byte("stats"))
+		if err != nil {
+			return err
+		}
+		usersB, err := stats.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return err
+		}
+		mapsB, err := stats.CreateBucketIfNotExists([]byte("maps"))
+		if err != nil {
+			return err
+		}
+		tokensB, err := stats.CreateBucketIfNotExists([]byte("tokens"))
+		if err != nil {
+			return err
+		}
+		for mapid, mu := range maps {
+			mb, err := mapsB.CreateBucketIfNotExists([]byte(strconv.Itoa(mapid)))
+			if err != nil {
+				return err
+			}
+			for user, d := range mu {
+				err = addStatsTo(mb, user, d)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for user, d := range users {
+			err = addStatsTo(usersB, user, d)
+			if err != nil {
+				return err
+			}
+		}
+		for token, ts := range tokens {
+			raw, err := json.Marshal(ts)
+			if err != nil {
+				return err
+			}
+			err = tokensB.Put([]byte(token), raw)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error updating stats", "error", err)
+	}
+}
+
+// flushStatsLoop flushes stats periodically until ctx is done. The last
+// counts are flushed on shutdown.
+func (m *Map) flushStatsLoop(ctx context.Context) {
+	t := time.NewTicker(statsFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		m.flushStats()
+	}
+}
+
+type UserStats struct {
+	User string `json:"user"`
+	UploadStats
+}
+
+type MapStats struct {
+	Map   int         `json:"map"`
+	Name  string      `json:"name"`
+	Users []UserStats `json:"users"`
+}
+
+type TokenInfo struct {
+	Token string `json:"token"`
+	TokenStats
+}
+
+type Stats struct {
+	Users  []UserStats `json:"users"`
+	Maps   []MapStats  `json:"maps"`
+	Tokens []TokenInfo `json:"tokens"`
+}
+
+func (m *Map) getStats() Stats {
+	m.flushStats()
+	st := Stats{
+		Users:  []UserStats{},
+		Maps:   []MapStats{},
+		Tokens: []TokenInfo{},
+	}
+	m.db.View(func(tx *bbolt.Tx) error {
+		stats := tx.Bucket([]byte("stats"))
+		// Every token of every user is listed, so unused ones show up too
+		if users := tx.Bucket([]byte("users")); users != nil {
+			var tokens *bbolt.Bucket
+			if stats != nil {
+				tokens = stats.Bucket([]byte("tokens"))
+			}
+			users.ForEach(func(k, v []byte) error {
+				u := User{}
+				json.Unmarshal(v, &u)
+				for _, tok := range u.Tokens {
+					// Tokens are upload credentials, only show enough
+					// to tell them apart
+					ti := TokenInfo{Token: tokenLabel(tok)}
+					ti.User = string(k)
+					if tokens != nil {
+						if raw := tokens.Get([]byte(tok)); raw != nil {
+							json.Unmarshal(raw, &ti.TokenStats)
+						}
+					}
+					st.Tokens = append(st.Tokens, ti)
+				}
+				return nil
+			})
+		}
+		if stats == nil {
+			return nil
+		}
+		if users := stats.Bucket([]byte("users")); users != nil {
+			users.ForEach(func(k, v []byte) error {
+				us := UserStats{User: string(k)}
+				json.Unmarshal(v, &us.UploadStats)
+				st.Users = append(st.Users, us)
+				return nil
+			})
+		}
+		maps := stats.Bucket([]byte("maps"))
+		if maps == nil {
+			return nil
+		}
+		mapB := tx.Bucket([]byte("maps"))
+		return maps.ForEach(func(k, v []byte) error {
+			mb := maps.Bucket(k)
+			if mb == nil {
+				return nil
+			}
+			ms := MapStats{Users: []UserStats{}}
+			ms.Map, _ = strconv.Atoi(string(k))
+			ms.Name = string(k)
+			if mapB != nil {
+				if raw := mapB.Get(k); raw != nil {
+					mi := MapInfo{}
+					json.Unmarshal(raw, &mi)
+					ms.Name = mi.Name
+				}
+			}
+			mb.ForEach(func(uk, uv []byte) error {
+				us := UserStats{User: string(uk)}
+				json.Unmarshal(uv, &us.UploadStats)
+				ms.Users = append(ms.Users, us)
+				return nil
+			})
+			sort.Slice(ms.Users, func(i, j int) bool {
+				return ms.Users[i].Tiles > ms.Users[j].Tiles
+			})
+			st.Maps = append(st.Maps, ms)
+			return nil
+		})
+	})
+	sort.Slice(st.Users, func(i, j int) bool {
+		return st.Users[i].Tiles > st.Users[j].Tiles
+	})
+	sort.Slice(st.Maps, func(i, j int) bool {
+		return st.Maps[i].Map < st.Maps[j].Map
+	})
+	sort.Slice(st.Tokens, func(i, j int) bool {
+		return st.Tokens[i].LastActivity.Before(st.Tokens[j].LastActivity)
+	})
+	return st
+}
+
+func (m *Map) adminStats(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
+		m.redirect(rw, req, "/")
+		return
+	}
+
+	if req.FormValue("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(m.getStats())
+		return
+	}
+
+	m.ExecuteTemplate(rw, "admin/stats.tmpl", struct {
+		Page    Page
+		Session *Session
+		Stats   Stats
+	}{
+		Page:    m.getPage(req),
+		Session: s,
+		Stats:   m.getStats(),
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// version can be set at build time with -ldflags "-X main.version=...",
+// otherwise the VCS revision recorded by the go tool is used.
+var version = ""
+
+var startTime = time.Now()
+
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return "dev"
+}
+
+func (m *Map) checkHealth() error {
+	err := m.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte("config")) == nil {
+			return fmt.Errorf("config bucket missing")
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("database: %w", err)
+	}
+	f, err := os.CreateTemp(m.gridStorage, ".healthz")
+	if err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+func (m *Map) healthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-cache")
+	err := m.checkHealth()
+	if err != nil {
+		logger(req).Warn("Health check failed", "error", err)
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+// readyz reports ready once migrations have run, and stops doing so as soon
+// as the server starts shutting down.
+func (m *Map) readyz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-cache")
+	if !m.ready.Load() {
+		http.Error(rw, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+type Status struct {
+	Version          string        `json:"version"`
+	ClientVersion    string        `json:"clientVersion"`
+	Started          time.Time     `json:"started"`
+	Uptime           time.Duration `json:"-"`
+	DBSize           ByteSize      `json:"dbSize"`
+	TileStore        string        `json:"tileStore"`
+	TileFiles        int           `json:"tileFiles"`
+	TileBytes        ByteSize      `json:"tileBytes"`
+	TileSubscribers  int           `json:"tileSubscribers"`
+	MergeSubscribers int           `json:"mergeSubscribers"`
+	Characters       int           `json:"characters"`
+	ZoomQueue        int           `json:"zoomQueue"`
+}
+
+func (m *Map) getStatus() Status {
+	st := Status{
+		Version:          buildVersion(),
+		TileStore:        m.cfg.TileStore,
+		ClientVersion:    VERSION,
+		Started:          startTime,
+		Uptime:           time.Since(startTime).Truncate(time.Second),
+		TileSubscribers:  m.gridUpdates.subscribers(),
+		MergeSubscribers: m.mergeUpdates.subscribers(),
+		ZoomQueue:        m.zoomQueueDepth(),
+	}
+	m.db.View(func(tx *bbolt.Tx) error {
+		st.DBSize = ByteSize(tx.Size())
+		return nil
+	})
+	m.tiles.Walk("", func(name string, size int64) error {
+		if strings.HasSuffix(name, ".png") {
+			st.TileFiles++
+			st.TileBytes += ByteSize(size)
+		}
+		return nil
+	})
+	m.chmu.RLock()
+	st.Characters = len(m.characters)
+	m.chmu.RUnlock()
+	return st
+}
+
+func (m *Map) adminStatus(rw http.ResponseWriter, req *http.Request) {
+	s := m.getSession(req)
+	if s == nil || !s.Auths.Has(AUTH_ADMIN) {
+		m.redirect(rw, req, "/")
+		return
+	}
+
+	if req.FormValue("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(m.getStatus())
+		return
+	}
+
+	m.ExecuteTemplate(rw, "admin/status.tmpl", struct {
+		Page    Page
+		Session *Session
+		Status  Status
+	}{
+		Page:    m.getPage(req),
+		Session: s,
+		Status:  m.getStatus(),
+	})
+}
+
+// ByteSize prints as a human readable size in templates.
+type ByteSize int64
+
+func (b ByteSize) String() string {
+	n := int64(b)
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
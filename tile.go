@@ -1,16 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
 	"net/http"
-	"path/filepath"
+	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/andyleap/hnh-map/tilestore"
+
 	"go.etcd.io/bbolt"
+	"golang.org/x/image/draw"
 )
 
 type TileData struct {
@@ -21,31 +34,92 @@ type TileData struct {
 	Cache int64
 }
 
+func decodeTile(store tilestore.Store, name string) (image.Image, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, img)
+	return buf.Bytes(), err
+}
+
+func putPNG(store tilestore.Store, name string, img image.Image) error {
+	data, err := encodePNG(img)
+	if err != nil {
+		return err
+	}
+	return store.Put(name, bytes.NewReader(data))
+}
+
+// serveTile serves a PNG or WebP image from store, answering conditional
+// requests from its hash for blobs, or modTime, which defaults to the file's
+// modification time.
+func serveTile(rw http.ResponseWriter, req *http.Request, store tilestore.Store, name string, modTime time.Time) {
+	f, err := store.Open(name)
+	if errors.Is(err, tilestore.ErrNotExist) {
+		http.Error(rw, "file not found", 404)
+		return
+	}
+	if err != nil {
+		logger(req).Error("Error opening tile", "file", name, "error", err)
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if path.Ext(name) == ".webp" {
+		rw.Header().Set("Content-Type", "image/webp")
+	} else {
+		rw.Header().Set("Content-Type", "image/png")
+	}
+	if hash := blobHash(name); hash != "" {
+		rw.Header().Set("ETag", "\""+hash+"\"")
+	}
+	if modTime.IsZero() {
+		modTime = f.ModTime()
+	}
+	http.ServeContent(rw, req, path.Base(name), modTime, f)
+}
+
 func (m *Map) GetTile(mapid int, c Coord, z int) (td *TileData) {
 	m.db.View(func(tx *bbolt.Tx) error {
-		tiles := tx.Bucket([]byte("tiles"))
-		if tiles == nil {
-			return nil
-		}
-		mapb := tiles.Bucket([]byte(strconv.Itoa(mapid)))
-		if mapb == nil {
-			return nil
-		}
-		zoom := mapb.Bucket([]byte(strconv.Itoa(z)))
-		if zoom == nil {
-			return nil
-		}
-		tileraw := zoom.Get([]byte(c.Name()))
-		if tileraw == nil {
-			return nil
-		}
-		json.Unmarshal(tileraw, &td)
+		td = m.getTile(tx, mapid, c, z)
 		return nil
 	})
 	return
 }
 
-func (m *Map) SaveTile(mapid int, c Coord, z int, f string, t int64) {
+func (m *Map) getTile(tx *bbolt.Tx, mapid int, c Coord, z int) (td *TileData) {
+	tiles := tx.Bucket([]byte("tiles"))
+	if tiles == nil {
+		return nil
+	}
+	mapb := tiles.Bucket([]byte(strconv.Itoa(mapid)))
+	if mapb == nil {
+		return nil
+	}
+	zoom := mapb.Bucket([]byte(strconv.Itoa(z)))
+	if zoom == nil {
+		return nil
+	}
+	tileraw := zoom.Get([]byte(c.Name()))
+	if tileraw == nil {
+		return nil
+	}
+	json.Unmarshal(tileraw, &td)
+	return
+}
+
+// SaveTile records f as the image of a tile and reports whether it changed.
+// Watchers are only told about tiles whose image changed.
+func (m *Map) SaveTile(mapid int, c Coord, z int, f string, t int64) bool {
+	var td *TileData
 	m.db.Update(func(tx *bbolt.Tx) error {
 		tiles, err := tx.CreateBucketIfNotExists([]byte("tiles"))
 		if err != nil {
@@ -59,24 +133,49 @@ func (m *Map) SaveTile(mapid int, c Coord, z int, f string, t int64) {
 		if err != nil {
 			return err
 		}
-		td := &TileData{
+		old := TileData{}
+		if raw := zoom.Get([]byte(c.Name())); raw != nil {
+			json.Unmarshal(raw, &old)
+			if f != "" && old.File == f {
+				return nil
+			}
+		}
+		err = retainBlob(tx, f)
+		if err != nil {
+			return err
+		}
+		err = releaseBlob(tx, old.File)
+		if err != nil {
+			return err
+		}
+		saved := &TileData{
 			MapID: mapid,
 			Coord: c,
 			Zoom:  z,
 			File:  f,
 			Cache: t,
 		}
-		raw, err := json.Marshal(td)
+		raw, err := json.Marshal(saved)
+		if err != nil {
+			return err
+		}
+		err = zoom.Put([]byte(c.Name()), raw)
 		if err != nil {
 			return err
 		}
-		m.gridUpdates.send(td)
-		return zoom.Put([]byte(c.Name()), raw)
+		td = saved
+		return nil
 	})
-	return
+	if td == nil {
+		return false
+	}
+	m.gridUpdates.send(td)
+	return true
 }
 
 func (m *Map) reportMerge(from, to int, shift Coord) {
+	m.clearHistoricCache(from)
+	m.clearHistoricCache(to)
 	m.mergeUpdates.send(&Merge{
 		From:  from,
 		To:    to,
@@ -86,6 +185,22 @@ func (m *Map) reportMerge(from, to int, shift Coord) {
 
 type TileCache struct {
 	M, X, Y, Z, T int
+	// S signs the tile URL in public tiles mode
+	S string `json:",omitempty"`
+}
+
+func (m *Map) tileCacheEntry(td *TileData) TileCache {
+	tc := TileCache{
+		M: td.MapID,
+		X: td.Coord.X,
+		Y: td.Coord.Y,
+		Z: td.Zoom,
+		T: int(td.Cache),
+	}
+	if m.cfg.PublicTiles && td.Cache > 0 {
+		tc.S = m.tileSig(td.MapID, td.Coord, td.Zoom, td.Cache)
+	}
+	return tc
 }
 
 func (m *Map) watchGridUpdates(rw http.ResponseWriter, req *http.Request) {
@@ -110,7 +225,9 @@ func (m *Map) watchGridUpdates(rw http.ResponseWriter, req *http.Request) {
 	mc := make(chan *Merge, 5)
 
 	m.gridUpdates.watch(c)
+	defer m.gridUpdates.unwatch(c)
 	m.mergeUpdates.watch(mc)
+	defer m.mergeUpdates.unwatch(mc)
 
 	tileCache := make([]TileCache, 0, 100)
 
@@ -132,13 +249,7 @@ func (m *Map) watchGridUpdates(rw http.ResponseWriter, req *http.Request) {
 				return zoom.ForEach(func(tk, tv []byte) error {
 					td := TileData{}
 					json.Unmarshal(tv, &td)
-					tileCache = append(tileCache, TileCache{
-						M: td.MapID,
-						X: td.Coord.X,
-						Y: td.Coord.Y,
-						Z: td.Zoom,
-						T: int(td.Cache),
-					})
+					tileCache = append(tileCache, m.tileCacheEntry(&td))
 					return nil
 				})
 			})
@@ -153,8 +264,11 @@ func (m *Map) watchGridUpdates(rw http.ResponseWriter, req *http.Request) {
 	flusher.Flush()
 
 	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-req.Context().Done():
+			return
 		case e, ok := <-c:
 			if !ok {
 				return
@@ -162,29 +276,22 @@ func (m *Map) watchGridUpdates(rw http.ResponseWriter, req *http.Request) {
 			found := false
 			for i := range tileCache {
 				if tileCache[i].M == e.MapID && tileCache[i].X == e.Coord.X && tileCache[i].Y == e.Coord.Y && tileCache[i].Z == e.Zoom {
-					tileCache[i].T = int(e.Cache)
+					tileCache[i] = m.tileCacheEntry(e)
 					found = true
 				}
 			}
 			if !found {
-				tileCache = append(tileCache, TileCache{
-					M: e.MapID,
-					X: e.Coord.X,
-					Y: e.Coord.Y,
-					Z: e.Zoom,
-					T: int(e.Cache),
-				})
+				tileCache = append(tileCache, m.tileCacheEntry(e))
 			}
 		case e, ok := <-mc:
-			log.Println(e, ok)
 			if !ok {
 				return
 			}
 			raw, err := json.Marshal(e)
 			if err != nil {
-				log.Println(err)
+				logger(req).Error("Error encoding merge", "error", err)
 			}
-			log.Println(string(raw))
+			logger(req).Debug("Sending merge", "from", e.From, "to", e.To, "shift", e.Shift)
 			fmt.Fprint(rw, "event: merge\n")
 			fmt.Fprint(rw, "data: ")
 			rw.Write(raw)
@@ -201,43 +308,152 @@ func (m *Map) watchGridUpdates(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-var tileRegex = regexp.MustCompile("([0-9]+)/([0-9]+)/([-0-9]+)_([-0-9]+).png")
+var tileRegex = regexp.MustCompile(`/([0-9]+)/([0-9]+)/(-?[0-9]+)_(-?[0-9]+)\.png$`)
 
-func (m *Map) gridTile(rw http.ResponseWriter, req *http.Request) {
-	s := m.getSession(req)
-	if s == nil || !s.Auths.Has(AUTH_MAP) {
-		rw.WriteHeader(http.StatusUnauthorized)
-		return
+// parseTilePath parses the map, zoom and coord from a path ending in
+// {map}/{z}/{x}_{y}.png.
+func parseTilePath(p string) (mapid int, z int, c Coord, err error) {
+	tile := tileRegex.FindStringSubmatch(p)
+	if tile == nil {
+		return 0, 0, Coord{}, fmt.Errorf("malformed tile path %q", p)
 	}
-	tile := tileRegex.FindStringSubmatch(req.URL.Path)
-	mapid, err := strconv.Atoi(tile[1])
-	if err != nil {
-		http.Error(rw, "request parsing error", http.StatusInternalServerError)
+	nums := [4]int{}
+	for i := range nums {
+		nums[i], err = strconv.Atoi(tile[i+1])
+		if err != nil {
+			return 0, 0, Coord{}, fmt.Errorf("malformed tile path %q: %w", p, err)
+		}
+	}
+	return nums[0], nums[1], Coord{X: nums[2], Y: nums[3]}, nil
+}
+
+// placeholderTile returns the image served for missing tiles, or nil to
+// answer 404.
+func (m *Map) placeholderTile() []byte {
+	m.placeholderOnce.Do(func() {
+		var fill color.Color
+		switch m.cfg.TilePlaceholder {
+		case "transparent":
+			fill = color.Transparent
+		case "unexplored":
+			fill = color.NRGBA{R: 0x10, G: 0x10, B: 0x10, A: 0xff}
+		default:
+			return
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+		draw.Draw(img, img.Bounds(), image.NewUniform(fill), image.Point{}, draw.Src)
+		data, err := encodePNG(img)
+		if err != nil {
+			slog.Error("Error encoding placeholder tile", "error", err)
+			return
+		}
+		m.placeholder = data
+	})
+	return m.placeholder
+}
+
+func (m *Map) missingTile(rw http.ResponseWriter, req *http.Request) {
+	data := m.placeholderTile()
+	if data == nil {
+		http.Error(rw, "file not found", 404)
 		return
 	}
-	z, err := strconv.Atoi(tile[2])
+	rw.Header().Set("Content-Type", "image/png")
+	rw.Header().Set("Cache-Control", "private, no-cache")
+	rw.Write(data)
+}
+
+// tileSig signs a tile version for public tiles mode, the signature only
+// stays valid until the tile changes.
+func (m *Map) tileSig(mapid int, c Coord, z int, cache int64) string {
+	mac := hmac.New(sha256.New, m.tileKey)
+	fmt.Fprintf(mac, "%d/%d/%s/%d", mapid, z, c.Name(), cache)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// loadTileKey returns the key tile URLs are signed with, creating it on
+// first use.
+func (m *Map) loadTileKey() ([]byte, error) {
+	var key []byte
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		config := tx.Bucket([]byte("config"))
+		key = append(key, config.Get([]byte("tileKey"))...)
+		if len(key) > 0 {
+			return nil
+		}
+		key = make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			return err
+		}
+		return config.Put([]byte("tileKey"), key)
+	})
+	return key, err
+}
+
+func (m *Map) gridTile(rw http.ResponseWriter, req *http.Request) {
+	mapid, z, c, err := parseTilePath(req.URL.Path)
 	if err != nil {
-		http.Error(rw, "request parsing error", http.StatusInternalServerError)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
-	x, err := strconv.Atoi(tile[3])
-	if err != nil {
-		http.Error(rw, "request parsing error", http.StatusInternalServerError)
+
+	// The frontend asks for grids/{map}/{z}/{x}_{y}.png?{cache}, so the URL
+	// changes whenever the tile does
+	version, _ := strconv.ParseInt(strings.SplitN(req.URL.RawQuery, "&", 2)[0], 10, 64)
+	sig := req.URL.Query().Get("sig")
+	at := req.FormValue("at")
+	signed := m.cfg.PublicTiles && at == "" && version > 0 && sig != "" &&
+		hmac.Equal([]byte(sig), []byte(m.tileSig(mapid, c, z, version)))
+	if !signed {
+		s := m.getSession(req)
+		if s == nil || !s.Auths.Has(AUTH_MAP) {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if at != "" {
+		m.historicTile(rw, req, mapid, c, z, at)
 		return
 	}
-	y, err := strconv.Atoi(tile[4])
-	if err != nil {
-		http.Error(rw, "request parsing error", http.StatusInternalServerError)
+
+	td := m.GetTile(mapid, c, z)
+
+	if td == nil || td.File == "" {
+		m.missingTile(rw, req)
 		return
 	}
-	td := m.GetTile(mapid, Coord{X: x, Y: y}, z)
 
-	if td == nil {
+	switch {
+	case signed && version == td.Cache:
+		rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	case signed:
+		// Signed for a version that has since been replaced
 		http.Error(rw, "file not found", 404)
 		return
+	case version == td.Cache:
+		rw.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	default:
+		rw.Header().Set("Cache-Control", "private, no-cache")
 	}
+	m.serveTileData(rw, req, td)
+}
 
-	rw.Header().Set("Cache-Control", "private immutable")
+// serveTileData serves the image of a tile, as WebP if enabled and accepted.
+func (m *Map) serveTileData(rw http.ResponseWriter, req *http.Request, td *TileData) {
+	modTime := time.Unix(0, td.Cache)
 
-	http.ServeFile(rw, req, filepath.Join(m.gridStorage, td.File))
+	if m.cfg.TileWebP && blobHash(td.File) != "" {
+		rw.Header().Set("Vary", "Accept")
+		if acceptsWebP(req) {
+			file, err := m.webpTile(td.File)
+			if err == nil {
+				rw.Header().Set("ETag", "\""+blobHash(td.File)+"-webp\"")
+				serveTile(rw, req, m.cache, file, modTime)
+				return
+			}
+			logger(req).Warn("Error encoding WebP tile, sending PNG", "file", td.File, "error", err)
+		}
+	}
+	serveTile(rw, req, m.tiles, td.File, modTime)
 }
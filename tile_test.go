@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestParseTilePath(t *testing.T) {
+	for _, tt := range []struct {
+		path  string
+		mapid int
+		z     int
+		c     Coord
+		ok    bool
+	}{
+		{"/map/grids/1/0/2_3.png", 1, 0, Coord{2, 3}, true},
+		{"/grids/12/5/0_0.png", 12, 5, Coord{0, 0}, true},
+		{"/hnh/map/grids/3/2/-4_-17.png", 3, 2, Coord{-4, -17}, true},
+		{"/map/grids/1/0/-1_5.png", 1, 0, Coord{-1, 5}, true},
+		{"/map/grids/1/0/5_-1.png", 1, 0, Coord{5, -1}, true},
+
+		{"/map/grids/1/0/2_3.jpg", 0, 0, Coord{}, false},
+		{"/map/grids/1/0/2_3.png.bak", 0, 0, Coord{}, false},
+		{"/map/grids/1/0/2_3", 0, 0, Coord{}, false},
+		{"/map/grids/1/0/2_3.PNG", 0, 0, Coord{}, false},
+		{"/map/grids/1/0/2.png", 0, 0, Coord{}, false},
+		{"/map/grids/1/-1/2_3.png", 0, 0, Coord{}, false},
+		{"/map/grids/-1/0/2_3.png", 0, 0, Coord{}, false},
+		{"/map/grids/a/0/2_3.png", 0, 0, Coord{}, false},
+		{"/map/grids/1/0/2_3.png?x=1", 0, 0, Coord{}, false},
+		{"", 0, 0, Coord{}, false},
+
+		{"/map/grids/99999999999999999999/0/2_3.png", 0, 0, Coord{}, false},
+		{"/map/grids/1/99999999999999999999/2_3.png", 0, 0, Coord{}, false},
+		{"/map/grids/1/0/99999999999999999999_3.png", 0, 0, Coord{}, false},
+		{"/map/grids/1/0/2_-99999999999999999999.png", 0, 0, Coord{}, false},
+	} {
+		mapid, z, c, err := parseTilePath(tt.path)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("parseTilePath(%q) = %d, %d, %v, want an error", tt.path, mapid, z, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTilePath(%q): %v", tt.path, err)
+			continue
+		}
+		if mapid != tt.mapid || z != tt.z || c != tt.c {
+			t.Errorf("parseTilePath(%q) = %d, %d, %v, want %d, %d, %v", tt.path, mapid, z, c, tt.mapid, tt.z, tt.c)
+		}
+	}
+}
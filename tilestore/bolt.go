@@ -0,0 +1,144 @@
+package tilestore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Bolt stores images in a bucket of the map database, keyed by name. Each
+// value is the modification time in unix nanoseconds, big endian, followed by
+// the image.
+type Bolt struct {
+	db     *bbolt.DB
+	bucket []byte
+}
+
+func NewBolt(db *bbolt.DB, bucket string) (*Bolt, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Bolt{db: db, bucket: []byte(bucket)}, nil
+}
+
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// dirPrefix returns the key prefix of everything under the prefix directory.
+func dirPrefix(prefix string) []byte {
+	prefix = cleanName(prefix)
+	if prefix == "" {
+		return nil
+	}
+	return []byte(prefix + "/")
+}
+
+type boltFile struct {
+	*bytes.Reader
+	modTime time.Time
+}
+
+func (f boltFile) Close() error {
+	return nil
+}
+
+func (f boltFile) ModTime() time.Time {
+	return f.modTime
+}
+
+func (f boltFile) Size() int64 {
+	return f.Reader.Size()
+}
+
+func (s *Bolt) Open(name string) (File, error) {
+	var f File
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(s.bucket).Get([]byte(cleanName(name)))
+		if len(v) < 8 {
+			return ErrNotExist
+		}
+		data := append([]byte{}, v[8:]...)
+		f = boltFile{
+			Reader:  bytes.NewReader(data),
+			modTime: time.Unix(0, int64(binary.BigEndian.Uint64(v))),
+		}
+		return nil
+	})
+	return f, err
+}
+
+func (s *Bolt) Put(name string, r io.Reader) error {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint64(time.Now().UnixNano()))
+	_, err := io.Copy(buf, r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(cleanName(name)), buf.Bytes())
+	})
+}
+
+func (s *Bolt) Remove(name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if b.Get([]byte(cleanName(name))) == nil {
+			return ErrNotExist
+		}
+		return b.Delete([]byte(cleanName(name)))
+	})
+}
+
+func (s *Bolt) RemoveAll(prefix string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+		p := dirPrefix(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Seek(p) {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Bolt) Rename(from, to string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		v := b.Get([]byte(cleanName(from)))
+		if v == nil {
+			return ErrNotExist
+		}
+		err := b.Put([]byte(cleanName(to)), append([]byte{}, v...))
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(cleanName(from)))
+	})
+}
+
+// Walk reads the images in one transaction, fn must not write to the store.
+func (s *Bolt) Walk(prefix string, fn func(name string, size int64) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+		p := dirPrefix(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			err := fn(string(k), int64(len(v)-8))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,126 @@
+package tilestore
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const tmpPrefix = ".tmp-"
+
+// FS stores images as files below a directory.
+type FS struct {
+	root string
+}
+
+func NewFS(root string) *FS {
+	return &FS{root: root}
+}
+
+func (s *FS) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+type file struct {
+	*os.File
+	info fs.FileInfo
+}
+
+func (f file) ModTime() time.Time {
+	return f.info.ModTime()
+}
+
+func (f file) Size() int64 {
+	return f.info.Size()
+}
+
+func (s *FS) Open(name string) (File, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, ErrNotExist
+	}
+	return file{File: f, info: info}, nil
+}
+
+// Put writes to a temporary file next to name and renames it into place, so
+// readers and crashes never see a partially written file.
+func (s *FS) Put(name string, r io.Reader) error {
+	p := s.path(name)
+	err := os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), tmpPrefix+filepath.Base(p)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *FS) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *FS) RemoveAll(prefix string) error {
+	return os.RemoveAll(s.path(prefix))
+}
+
+func (s *FS) Rename(from, to string) error {
+	err := os.MkdirAll(filepath.Dir(s.path(to)), 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.path(from), s.path(to))
+}
+
+func (s *FS) Walk(prefix string, fn func(name string, size int64) error) error {
+	err := filepath.WalkDir(s.path(prefix), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tmpPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info.Size())
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
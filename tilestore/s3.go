@@ -0,0 +1,189 @@
+package tilestore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config describes an S3 compatible bucket, such as AWS S3 or MinIO.
+type S3Config struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Region    string
+	Bucket    string
+	// Prefix is prepended to every object name, so several maps can share
+	// a bucket.
+	Prefix string
+	UseSSL bool
+}
+
+// S3 stores images as objects in a bucket.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 connects to the bucket, creating it if it doesn't exist yet.
+func NewS3(cfg S3Config) (*S3, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, err
+		}
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{client: client, bucket: cfg.Bucket, prefix: prefix}, nil
+}
+
+func (s *S3) key(name string) string {
+	return s.prefix + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func isNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "NoSuchKey" || resp.StatusCode == 404
+}
+
+type object struct {
+	*minio.Object
+	info minio.ObjectInfo
+}
+
+func (o object) ModTime() time.Time {
+	return o.info.LastModified
+}
+
+func (o object) Size() int64 {
+	return o.info.Size
+}
+
+func (s *S3) Open(name string) (File, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if isNotFound(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	return object{Object: obj, info: info}, nil
+}
+
+// Put uploads r in a single request, objects are replaced atomically.
+func (s *S3) Put(name string, r io.Reader) error {
+	// Reading the image first gives minio a known size, with an unknown size
+	// it buffers a full multipart chunk
+	buf := &bytes.Buffer{}
+	_, err := io.Copy(buf, r)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(context.Background(), s.bucket, s.key(name), buf, int64(buf.Len()), minio.PutObjectOptions{
+		ContentType: "image/png",
+	})
+	return err
+}
+
+func (s *S3) Remove(name string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *S3) RemoveAll(prefix string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := make(chan minio.ObjectInfo)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(objects)
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.dir(prefix), Recursive: true}) {
+			if obj.Err != nil {
+				listErr <- obj.Err
+				return
+			}
+			select {
+			case objects <- obj:
+			case <-ctx.Done():
+				listErr <- ctx.Err()
+				return
+			}
+		}
+		listErr <- nil
+	}()
+	for rerr := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if rerr.Err != nil {
+			return rerr.Err
+		}
+	}
+	return <-listErr
+}
+
+func (s *S3) Rename(from, to string) error {
+	ctx := context.Background()
+	_, err := s.client.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket: s.bucket,
+		Object: s.key(to),
+	}, minio.CopySrcOptions{
+		Bucket: s.bucket,
+		Object: s.key(from),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return ErrNotExist
+		}
+		return err
+	}
+	return s.Remove(from)
+}
+
+// dir is the key prefix for everything below the prefix directory.
+func (s *S3) dir(prefix string) string {
+	d := s.key(prefix)
+	if d != "" && !strings.HasSuffix(d, "/") {
+		d += "/"
+	}
+	return d
+}
+
+func (s *S3) Walk(prefix string, fn func(name string, size int64) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.dir(prefix), Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		err := fn(strings.TrimPrefix(obj.Key, s.prefix), obj.Size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package tilestore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in memory stand-in for MinIO, with just the path style API
+// calls the S3 store makes. Signatures are not checked.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]fakeObject
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (o fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3Error(rw http.ResponseWriter, code int, s3code string) {
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(code)
+	fmt.Fprintf(rw, "<Error><Code>%s</Code><Message>%s</Message></Error>", s3code, s3code)
+}
+
+// readBody decodes aws-chunked uploads, which minio-go sends over plain
+// HTTP.
+func readBody(req *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(req.Body)
+	}
+	body := bufio.NewReader(req.Body)
+	buf := &bytes.Buffer{}
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(strings.SplitN(line, ";", 2)[0]), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return buf.Bytes(), nil
+		}
+		_, err = io.CopyN(buf, body, size)
+		if err != nil {
+			return nil, err
+		}
+		body.Discard(2)
+	}
+}
+
+func (f *fakeS3) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	bucket, ok := f.buckets[bucketName]
+	q := req.URL.Query()
+
+	switch {
+	case key == "" && req.Method == http.MethodPut:
+		f.buckets[bucketName] = map[string]fakeObject{}
+	case !ok:
+		s3Error(rw, http.StatusNotFound, "NoSuchBucket")
+	case key == "" && req.Method == http.MethodHead:
+	case key == "" && req.Method == http.MethodGet && q.Get("list-type") == "2":
+		type content struct {
+			Key          string
+			Size         int
+			LastModified string
+			ETag         string
+		}
+		res := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			Prefix      string
+			KeyCount    int
+			IsTruncated bool
+			Contents    []content
+		}{Name: bucketName, Prefix: q.Get("prefix")}
+		keys := []string{}
+		for k := range bucket {
+			if strings.HasPrefix(k, res.Prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			o := bucket[k]
+			res.Contents = append(res.Contents, content{k, len(o.data), o.modTime.Format(time.RFC3339), o.etag()})
+		}
+		res.KeyCount = len(res.Contents)
+		xml.NewEncoder(rw).Encode(res)
+	case key == "" && req.Method == http.MethodPost && q.Has("delete"):
+		del := struct {
+			Object []struct{ Key string }
+		}{}
+		xml.NewDecoder(req.Body).Decode(&del)
+		out := &bytes.Buffer{}
+		out.WriteString("<DeleteResult>")
+		for _, o := range del.Object {
+			delete(bucket, o.Key)
+			fmt.Fprintf(out, "<Deleted><Key>%s</Key></Deleted>", o.Key)
+		}
+		out.WriteString("</DeleteResult>")
+		rw.Write(out.Bytes())
+	case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(req.Header.Get("X-Amz-Copy-Source"))
+		srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+		o, ok := f.buckets[srcBucket][srcKey]
+		if !ok {
+			s3Error(rw, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		o.modTime = time.Now()
+		bucket[key] = o
+		fmt.Fprintf(rw, "<CopyObjectResult><LastModified>%s</LastModified><ETag>%s</ETag></CopyObjectResult>",
+			o.modTime.Format(time.RFC3339), o.etag())
+	case req.Method == http.MethodPut:
+		data, err := readBody(req)
+		if err != nil {
+			s3Error(rw, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		o := fakeObject{data: data, modTime: time.Now()}
+		bucket[key] = o
+		rw.Header().Set("ETag", o.etag())
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		o, ok := bucket[key]
+		if !ok {
+			s3Error(rw, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		rw.Header().Set("ETag", o.etag())
+		http.ServeContent(rw, req, "", o.modTime, bytes.NewReader(o.data))
+	case req.Method == http.MethodDelete:
+		delete(bucket, key)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(rw, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// TestS3 runs against a real bucket when TILESTORE_S3_ENDPOINT is set, e.g.
+// a local MinIO with TILESTORE_S3_ACCESS_KEY and TILESTORE_S3_SECRET_KEY,
+// and against fakeS3 otherwise.
+func TestS3(t *testing.T) {
+	cfg := S3Config{
+		Endpoint:  os.Getenv("TILESTORE_S3_ENDPOINT"),
+		AccessKey: os.Getenv("TILESTORE_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("TILESTORE_S3_SECRET_KEY"),
+		Region:    "us-east-1",
+		Bucket:    fmt.Sprintf("tilestore-test-%d", time.Now().UnixNano()),
+		Prefix:    "/maps/",
+	}
+	if cfg.Endpoint == "" {
+		srv := httptest.NewServer(&fakeS3{buckets: map[string]map[string]fakeObject{}})
+		defer srv.Close()
+		cfg.Endpoint = strings.TrimPrefix(srv.URL, "http://")
+		cfg.AccessKey, cfg.SecretKey = "access", "secret"
+	}
+	s, err := NewS3(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+
+	// Names are given without the prefix
+	put(t, s, "blobs/ab/abcd.png", "image")
+	if got := walk(t, s, "blobs"); len(got) != 1 || got[0] != "blobs/ab/abcd.png" {
+		t.Errorf("Walk = %v", got)
+	}
+	s.RemoveAll("")
+}
@@ -0,0 +1,174 @@
+package tilestore
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func put(t *testing.T, s Store, name, content string) {
+	t.Helper()
+	err := s.Put(name, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put(%q): %v", name, err)
+	}
+}
+
+func read(t *testing.T, s Store, name string) string {
+	t.Helper()
+	f, err := s.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", name, err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading %q: %v", name, err)
+	}
+	if f.Size() != int64(len(b)) {
+		t.Errorf("%q Size() = %d, read %d bytes", name, f.Size(), len(b))
+	}
+	if f.ModTime().IsZero() {
+		t.Errorf("%q has no ModTime", name)
+	}
+	return string(b)
+}
+
+func walk(t *testing.T, s Store, prefix string) []string {
+	t.Helper()
+	names := []string{}
+	err := s.Walk(prefix, func(name string, size int64) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk(%q): %v", prefix, err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func assertMissing(t *testing.T, s Store, name string) {
+	t.Helper()
+	f, err := s.Open(name)
+	if err == nil {
+		f.Close()
+		t.Fatalf("Open(%q) found a removed image", name)
+	}
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Open(%q) = %v, want ErrNotExist", name, err)
+	}
+}
+
+// testStore checks the behaviour every Store has to share.
+func testStore(t *testing.T, s Store) {
+	assertMissing(t, s, "blobs/ab/missing.png")
+	if names := walk(t, s, "nothing"); len(names) != 0 {
+		t.Errorf("Walk of a missing prefix = %v", names)
+	}
+
+	put(t, s, "blobs/ab/abcd.png", "first")
+	put(t, s, "blobs/ab/abcd.png", "second")
+	if got := read(t, s, "blobs/ab/abcd.png"); got != "second" {
+		t.Errorf("after replacing got %q", got)
+	}
+
+	f, err := s.Open("blobs/ab/abcd.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(3, io.SeekStart)
+	rest, _ := io.ReadAll(f)
+	f.Close()
+	if string(rest) != "ond" {
+		t.Errorf("read %q after seeking", rest)
+	}
+
+	put(t, s, "blobs/cd/cdef.png", "other")
+	put(t, s, "blobsx/ab.png", "sibling")
+	put(t, s, "1/0/0_0.png", "cached")
+	want := []string{"blobs/ab/abcd.png", "blobs/cd/cdef.png"}
+	if got := walk(t, s, "blobs"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk(blobs) = %v, want %v", got, want)
+	}
+	if got := walk(t, s, ""); len(got) != 4 {
+		t.Errorf("Walk of everything = %v", got)
+	}
+
+	err = s.Rename("blobs/cd/cdef.png", "webp/cd/cdef.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, s, "blobs/cd/cdef.png")
+	if got := read(t, s, "webp/cd/cdef.webp"); got != "other" {
+		t.Errorf("renamed image has %q", got)
+	}
+	err = s.Rename("blobs/cd/missing.png", "blobs/cd/elsewhere.png")
+	if !errors.Is(err, ErrNotExist) {
+		t.Errorf("Rename of a missing image = %v, want ErrNotExist", err)
+	}
+
+	err = s.Remove("webp/cd/cdef.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, s, "webp/cd/cdef.webp")
+
+	err = s.RemoveAll("blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, s, "blobs/ab/abcd.png")
+	if got := read(t, s, "blobsx/ab.png"); got != "sibling" {
+		t.Errorf("RemoveAll(blobs) touched blobsx, got %q", got)
+	}
+	err = s.RemoveAll("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := walk(t, s, ""); len(got) != 0 {
+		t.Errorf("left after RemoveAll of everything: %v", got)
+	}
+}
+
+func TestFS(t *testing.T) {
+	testStore(t, NewFS(t.TempDir()))
+}
+
+func TestFSIgnoresTempFiles(t *testing.T) {
+	root := t.TempDir()
+	s := NewFS(root)
+	put(t, s, "blobs/ab/abcd.png", "image")
+	// Left behind by a crash during Put
+	put(t, s, "blobs/ab/"+tmpPrefix+"abcd.png-123", "partial")
+	if got := walk(t, s, "blobs"); len(got) != 1 || got[0] != "blobs/ab/abcd.png" {
+		t.Errorf("Walk = %v", got)
+	}
+}
+
+func TestFSStaysInRoot(t *testing.T) {
+	root := t.TempDir()
+	s := NewFS(filepath.Join(root, "store"))
+	put(t, s, "../../escape.png", "image")
+	if got := read(t, NewFS(filepath.Join(root, "store")), "escape.png"); got != "image" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestBolt(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, err := NewBolt(db, "tilestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
@@ -0,0 +1,34 @@
+// Package tilestore holds the tile images behind the map, on local disk, in
+// the map database or in an S3 compatible bucket.
+package tilestore
+
+import (
+	"io"
+	"io/fs"
+	"time"
+)
+
+// ErrNotExist is returned by Open for missing tiles.
+var ErrNotExist = fs.ErrNotExist
+
+// File is an open tile image.
+type File interface {
+	io.ReadSeekCloser
+	ModTime() time.Time
+	Size() int64
+}
+
+// Store keeps images under slash separated names such as
+// "blobs/ab/abcd.png", the same names stored in TileData.File.
+type Store interface {
+	Open(name string) (File, error)
+	// Put replaces name with the contents of r. Readers see either the old
+	// or the new image, never a partial write.
+	Put(name string, r io.Reader) error
+	Remove(name string) error
+	// RemoveAll removes every image under the prefix directory.
+	RemoveAll(prefix string) error
+	Rename(from, to string) error
+	// Walk calls fn for every image under the prefix directory.
+	Walk(prefix string, fn func(name string, size int64) error) error
+}
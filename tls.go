@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func (c ServerConfig) tlsEnabled() bool {
+	return c.TLSCert != "" || c.ACMEDomains != ""
+}
+
+func (c ServerConfig) acmeDomains() []string {
+	domains := []string{}
+	for _, d := range strings.Split(c.ACMEDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// setupTLS returns the TLS config for the main listener, and the handler for
+// the plain HTTP listener, which redirects to HTTPS and answers ACME
+// challenges. Both are nil when TLS is disabled.
+func setupTLS(cfg ServerConfig) (*tls.Config, http.Handler, error) {
+	if !cfg.tlsEnabled() {
+		return nil, nil, nil
+	}
+	redirect := httpsRedirect(cfg.Port)
+
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, redirect, nil
+	}
+
+	cacheDir := cfg.ACMECacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(cfg.GridStorage, "autocert")
+	}
+	allowed := autocert.HostWhitelist(cfg.acmeDomains()...)
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir),
+		// HTTP challenges carry the port in the host when http_port isn't
+		// 80, as happens when testing against a local ACME server
+		HostPolicy: func(ctx context.Context, host string) error {
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return allowed(ctx, host)
+		},
+		Email: cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectory}
+	}
+	return m.TLSConfig(), m.HTTPHandler(redirect), nil
+}
+
+func httpsRedirect(port int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is a minimal RFC 8555 CA for a single order, in the spirit of
+// Pebble. It only offers http-01 challenges, which it checks by calling the
+// server's plain HTTP handler directly.
+type fakeACME struct {
+	t       *testing.T
+	srv     *httptest.Server
+	handler http.Handler
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	thumbprint string
+	domain     string
+	authzValid bool
+	cert       []byte
+}
+
+const fakeACMEToken = "fake-token"
+
+func newFakeACME(t *testing.T) *fakeACME {
+	f := &fakeACME{t: t}
+	var err error
+	f.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &f.caKey.PublicKey, f.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.caCert, _ = x509.ParseCertificate(der)
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeACME) url(p string) string {
+	return f.srv.URL + p
+}
+
+func (f *fakeACME) order() map[string]any {
+	o := map[string]any{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": f.domain}},
+		"authorizations": []string{f.url("/authz/1")},
+		"finalize":       f.url("/finalize/1"),
+	}
+	if f.authzValid {
+		o["status"] = "ready"
+	}
+	if f.cert != nil {
+		o["status"] = "valid"
+		o["certificate"] = f.url("/cert/1")
+	}
+	return o
+}
+
+func (f *fakeACME) serve(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rw.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+	if req.URL.Path == "/dir" {
+		json.NewEncoder(rw).Encode(map[string]any{
+			"newNonce":   f.url("/nonce"),
+			"newAccount": f.url("/account"),
+			"newOrder":   f.url("/order"),
+			"revokeCert": f.url("/revoke"),
+			"keyChange":  f.url("/key-change"),
+			"meta":       map[string]string{"termsOfService": f.url("/tos")},
+		})
+		return
+	}
+	if req.URL.Path == "/nonce" {
+		return
+	}
+
+	jws := struct{ Protected, Payload string }{}
+	json.NewDecoder(req.Body).Decode(&jws)
+	protected := struct {
+		JWK map[string]string `json:"jwk"`
+	}{}
+	raw, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	json.Unmarshal(raw, &protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	rw.Header().Set("Content-Type", "application/json")
+	switch req.URL.Path {
+	case "/account":
+		jwk := protected.JWK
+		sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk["crv"], jwk["x"], jwk["y"])))
+		f.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+		rw.Header().Set("Location", f.url("/account/1"))
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{"status":"valid"}`)
+	case "/order":
+		o := struct {
+			Identifiers []struct{ Value string }
+		}{}
+		json.Unmarshal(payload, &o)
+		f.domain = o.Identifiers[0].Value
+		rw.Header().Set("Location", f.url("/order/1"))
+		rw.WriteHeader(http.StatusCreated)
+		json.NewEncoder(rw).Encode(f.order())
+	case "/order/1":
+		json.NewEncoder(rw).Encode(f.order())
+	case "/authz/1":
+		status := "pending"
+		if f.authzValid {
+			status = "valid"
+		}
+		json.NewEncoder(rw).Encode(map[string]any{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": f.domain},
+			"challenges": []map[string]string{{
+				"type": "http-01", "url": f.url("/chal/1"), "token": fakeACMEToken, "status": status,
+			}},
+		})
+	case "/chal/1":
+		creq := httptest.NewRequest("GET", "http://"+f.domain+"/.well-known/acme-challenge/"+fakeACMEToken, nil)
+		crw := httptest.NewRecorder()
+		f.handler.ServeHTTP(crw, creq)
+		f.authzValid = crw.Code == http.StatusOK && crw.Body.String() == fakeACMEToken+"."+f.thumbprint
+		if !f.authzValid {
+			f.t.Errorf("http-01 challenge answered %d %q", crw.Code, crw.Body.String())
+		}
+		json.NewEncoder(rw).Encode(map[string]string{
+			"type": "http-01", "url": f.url("/chal/1"), "token": fakeACMEToken, "status": "valid",
+		})
+	case "/finalize/1":
+		fin := struct{ CSR string }{}
+		json.Unmarshal(payload, &fin)
+		der, _ := base64.RawURLEncoding.DecodeString(fin.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		f.cert, err = x509.CreateCertificate(rand.Reader, tmpl, f.caCert, csr.PublicKey, f.caKey)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(rw).Encode(f.order())
+	case "/cert/1":
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(rw, &pem.Block{Type: "CERTIFICATE", Bytes: f.cert})
+		pem.Encode(rw, &pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func TestACME(t *testing.T) {
+	f := newFakeACME(t)
+	cfg := defaultConfig()
+	cfg.Port = 443
+	cfg.ACMEDomains = "map.example.com, other.example.com"
+	cfg.ACMEDirectory = f.url("/dir")
+	cfg.ACMECacheDir = t.TempDir()
+	tlsConfig, handler, err := setupTLS(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.handler = handler
+
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "map.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if got := cert.Leaf.DNSNames; len(got) != 1 || got[0] != "map.example.com" {
+		t.Errorf("certificate for %v, want map.example.com", got)
+	}
+
+	_, err = tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.example.com"})
+	if err == nil {
+		t.Error("got a certificate for a domain not in acme_domains")
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "http://map.example.com/map/?a=1", nil))
+	if rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != "https://map.example.com/map/?a=1" {
+		t.Errorf("plain HTTP got %d to %q", rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+func TestHTTPSRedirectPort(t *testing.T) {
+	rw := httptest.NewRecorder()
+	httpsRedirect(8443).ServeHTTP(rw, httptest.NewRequest("GET", "http://localhost:8080/login", nil))
+	loc := rw.Header().Get("Location")
+	if !strings.HasPrefix(loc, "https://localhost:8443/login") {
+		t.Errorf("redirected to %q", loc)
+	}
+}
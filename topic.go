@@ -3,14 +3,41 @@ package main
 import "sync"
 
 type topic struct {
-	c  []chan *TileData
-	mu sync.Mutex
+	name   string
+	c      []chan *TileData
+	mu     sync.Mutex
+	closed bool
 }
 
 func (t *topic) watch(c chan *TileData) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if t.closed {
+		close(c)
+		return
+	}
 	t.c = append(t.c, c)
+	sseSubscribers.WithLabelValues(t.name).Set(float64(len(t.c)))
+}
+
+// unwatch ends the subscription of c, if it is still subscribed.
+func (t *topic) unwatch(c chan *TileData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.c {
+		if t.c[i] == c {
+			t.c[i] = t.c[len(t.c)-1]
+			t.c = t.c[:len(t.c)-1]
+			sseSubscribers.WithLabelValues(t.name).Set(float64(len(t.c)))
+			return
+		}
+	}
+}
+
+func (t *topic) subscribers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.c)
 }
 
 func (t *topic) send(b *TileData) {
@@ -23,15 +50,24 @@ func (t *topic) send(b *TileData) {
 			close(t.c[i])
 			t.c[i] = t.c[len(t.c)-1]
 			t.c = t.c[:len(t.c)-1]
+			i--
+			sseDropped.WithLabelValues(t.name).Inc()
+			sseSubscribers.WithLabelValues(t.name).Set(float64(len(t.c)))
 		}
 	}
 }
 
+// close ends every subscription, and any made afterwards, so streams can
+// finish when the server shuts down.
 func (t *topic) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
 	for _, c := range t.c {
 		close(c)
 	}
 	t.c = t.c[:0]
+	sseSubscribers.WithLabelValues(t.name).Set(0)
 }
 
 type Merge struct {
@@ -40,14 +76,41 @@ type Merge struct {
 }
 
 type mergeTopic struct {
-	c  []chan *Merge
-	mu sync.Mutex
+	name   string
+	c      []chan *Merge
+	mu     sync.Mutex
+	closed bool
 }
 
 func (t *mergeTopic) watch(c chan *Merge) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if t.closed {
+		close(c)
+		return
+	}
 	t.c = append(t.c, c)
+	sseSubscribers.WithLabelValues(t.name).Set(float64(len(t.c)))
+}
+
+// unwatch ends the subscription of c, if it is still subscribed.
+func (t *mergeTopic) unwatch(c chan *Merge) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.c {
+		if t.c[i] == c {
+			t.c[i] = t.c[len(t.c)-1]
+			t.c = t.c[:len(t.c)-1]
+			sseSubscribers.WithLabelValues(t.name).Set(float64(len(t.c)))
+			return
+		}
+	}
+}
+
+func (t *mergeTopic) subscribers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.c)
 }
 
 func (t *mergeTopic) send(b *Merge) {
@@ -60,13 +123,22 @@ func (t *mergeTopic) send(b *Merge) {
 			close(t.c[i])
 			t.c[i] = t.c[len(t.c)-1]
 			t.c = t.c[:len(t.c)-1]
+			i--
+			sseDropped.WithLabelValues(t.name).Inc()
+			sseSubscribers.WithLabelValues(t.name).Set(float64(len(t.c)))
 		}
 	}
 }
 
+// close ends every subscription, and any made afterwards, so streams can
+// finish when the server shuts down.
 func (t *mergeTopic) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
 	for _, c := range t.c {
 		close(c)
 	}
 	t.c = t.c[:0]
+	sseSubscribers.WithLabelValues(t.name).Set(0)
 }
@@ -3,13 +3,17 @@ package webapp
 import (
 	"html/template"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"sync"
 )
 
 type WebApp struct {
 	templates *template.Template
+
+	mu     sync.RWMutex
+	fsys   fs.FS
+	reload bool
 }
 
 func New() *WebApp {
@@ -26,27 +30,60 @@ func Must(w *WebApp, err error) *WebApp {
 }
 
 func (w *WebApp) LoadTemplates(path string) (*WebApp, error) {
-	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+	return w.LoadTemplatesFS(os.DirFS(path))
+}
+
+// LoadTemplatesFS parses every file in fsys as a template named by its path.
+func (w *WebApp) LoadTemplatesFS(fsys fs.FS) (*WebApp, error) {
+	t, err := parseTemplates(fsys)
+	if err != nil {
+		return w, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.templates = t
+	w.fsys = fsys
+	return w, nil
+}
+
+// HotReload makes every render parse the templates again, so edits show up
+// without a restart.
+func (w *WebApp) HotReload() *WebApp {
+	w.reload = true
+	return w
+}
+
+func parseTemplates(fsys fs.FS) (*template.Template, error) {
+	t := template.New("")
+	err := fs.WalkDir(fsys, ".", func(file string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
+		if d.IsDir() {
 			return nil
 		}
-		name, err := filepath.Rel(path, file)
+		raw, err := fs.ReadFile(fsys, file)
 		if err != nil {
 			return err
 		}
-		raw, err := ioutil.ReadFile(file)
-		if err != nil {
-			return err
-		}
-		_, err = w.templates.New(name).Parse(string(raw))
+		_, err = t.New(file).Parse(string(raw))
 		return err
 	})
-	return w, err
+	return t, err
 }
 
 func (w *WebApp) ExecuteTemplate(wr io.Writer, t string, data interface{}) error {
-	return w.templates.ExecuteTemplate(wr, t, data)
-}
\ No newline at end of file
+	if w.reload && w.fsys != nil {
+		templates, err := parseTemplates(w.fsys)
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		w.templates = templates
+		w.mu.Unlock()
+	}
+	w.mu.RLock()
+	templates := w.templates
+	w.mu.RUnlock()
+	return templates.ExecuteTemplate(wr, t, data)
+}
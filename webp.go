@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// Tiles are stored as PNG. With tile_webp set, browsers that accept WebP are
+// sent a lossless WebP copy instead, encoded on first request and kept in the
+// local cache next to the historic tiles.
+func webpFile(hash string) string {
+	return fmt.Sprintf("webp/%s/%s.webp", hash[:2], hash)
+}
+
+func acceptsWebP(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "image/webp")
+}
+
+// webpTile returns the cached WebP copy of a blob, encoding it if needed.
+func (m *Map) webpTile(file string) (string, error) {
+	name := webpFile(blobHash(file))
+	if f, err := m.cache.Open(name); err == nil {
+		f.Close()
+		return name, nil
+	}
+	img, err := decodeTile(m.tiles, file)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	err = nativewebp.Encode(buf, img, nil)
+	if err != nil {
+		return "", err
+	}
+	return name, m.cache.Put(name, buf)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.etcd.io/bbolt"
+)
+
+// Maps are also served for GIS tools and other map libraries, as an XYZ
+// pyramid with z 0 the most zoomed out level, and through WMTS. Both count
+// tiles from 0 at an origin, the grid at the top left corner of the map's
+// most zoomed out tiles. The origin is part of the URL so tile URLs don't
+// move when the map grows. Both take a read only API key as ?key=.
+
+var (
+	xyzPath  = regexp.MustCompile(`^/map/xyz/([0-9]+)/(-?[0-9]+)_(-?[0-9]+)/([0-9]+)/([0-9]+)/([0-9]+)\.png$`)
+	wmtsPath = regexp.MustCompile(`^/map/wmts/([0-9]+)/(-?[0-9]+)_(-?[0-9]+)/([0-9]+)/([0-9]+)/([0-9]+)\.png$`)
+)
+
+// apiAuths returns the roles of the logged in session. An API key only ever
+// grants viewing the map and its markers, and only the roles its user has.
+func (m *Map) apiAuths(req *http.Request) Auths {
+	if s := m.getSession(req); s != nil {
+		return s.Auths
+	}
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		return nil
+	}
+	var auths Auths
+	m.db.View(func(tx *bbolt.Tx) error {
+		kb := tx.Bucket([]byte("apikeys"))
+		ub := tx.Bucket([]byte("users"))
+		if kb == nil || ub == nil {
+			return nil
+		}
+		userName := kb.Get([]byte(key))
+		if userName == nil {
+			return nil
+		}
+		userRaw := ub.Get(userName)
+		if userRaw == nil {
+			return nil
+		}
+		u := User{}
+		json.Unmarshal(userRaw, &u)
+		for _, auth := range []string{AUTH_MAP, AUTH_MARKERS} {
+			if u.Auths.Has(auth) {
+				auths = append(auths, auth)
+			}
+		}
+		return nil
+	})
+	return auths
+}
+
+// xyzTile serves /map/xyz/{map}/{ox}_{oy}/{z}/{x}/{y}.png.
+func (m *Map) xyzTile(rw http.ResponseWriter, req *http.Request) {
+	if !m.apiAuths(req).Has(AUTH_MAP) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	nums, ok := parseInts(xyzPath, req.URL.Path)
+	if !ok {
+		http.Error(rw, "malformed tile path", http.StatusBadRequest)
+		return
+	}
+	m.serveAPITile(rw, req, nums[0], nums[1], nums[2], nums[3], nums[4], nums[5])
+}
+
+// wmtsTile serves /map/wmts/{map}/{ox}_{oy}/{matrix}/{row}/{col}.png.
+func (m *Map) wmtsTile(rw http.ResponseWriter, req *http.Request) {
+	if !m.apiAuths(req).Has(AUTH_MAP) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	nums, ok := parseInts(wmtsPath, req.URL.Path)
+	if !ok {
+		http.Error(rw, "malformed tile path", http.StatusBadRequest)
+		return
+	}
+	m.serveAPITile(rw, req, nums[0], nums[1], nums[2], nums[3], nums[5], nums[4])
+}
+
+// serveAPITile serves tile x, y of level level, counting levels from the
+// most zoomed out and tiles from the origin grid ox, oy.
+func (m *Map) serveAPITile(rw http.ResponseWriter, req *http.Request, mapid, ox, oy, level, x, y int) {
+	if level > m.cfg.ZoomLevels {
+		m.missingTile(rw, req)
+		return
+	}
+	z := m.cfg.ZoomLevels - level
+	c := Coord{X: floorDiv(ox, 1<<z) + x, Y: floorDiv(oy, 1<<z) + y}
+	td := m.GetTile(mapid, c, z)
+	if td == nil || td.File == "" {
+		m.missingTile(rw, req)
+		return
+	}
+	rw.Header().Set("Cache-Control", "private, no-cache")
+	m.serveTileData(rw, req, td)
+}
+
+func parseInts(re *regexp.Regexp, p string) ([]int, bool) {
+	matches := re.FindStringSubmatch(p)
+	if matches == nil {
+		return nil, false
+	}
+	nums := make([]int, len(matches)-1)
+	for i := range nums {
+		n, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return nil, false
+		}
+		nums[i] = n
+	}
+	return nums, true
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+type wmtsCapabilities struct {
+	XMLName  xml.Name `xml:"Capabilities"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	XmlnsOWS string   `xml:"xmlns:ows,attr"`
+	Version  string   `xml:"version,attr"`
+
+	Title       string `xml:"ows:ServiceIdentification>ows:Title"`
+	ServiceType string `xml:"ows:ServiceIdentification>ows:ServiceType"`
+	TypeVersion string `xml:"ows:ServiceIdentification>ows:ServiceTypeVersion"`
+
+	Layers         []wmtsLayer         `xml:"Contents>Layer"`
+	TileMatrixSets []wmtsTileMatrixSet `xml:"Contents>TileMatrixSet"`
+}
+
+type wmtsLayer struct {
+	Title         string `xml:"ows:Title"`
+	Identifier    string `xml:"ows:Identifier"`
+	Style         string `xml:"Style>ows:Identifier"`
+	Format        string `xml:"Format"`
+	TileMatrixSet string `xml:"TileMatrixSetLink>TileMatrixSet"`
+	ResourceURL   struct {
+		Format       string `xml:"format,attr"`
+		ResourceType string `xml:"resourceType,attr"`
+		Template     string `xml:"template,attr"`
+	} `xml:"ResourceURL"`
+}
+
+type wmtsTileMatrixSet struct {
+	Identifier   string           `xml:"ows:Identifier"`
+	SupportedCRS string           `xml:"ows:SupportedCRS"`
+	TileMatrices []wmtsTileMatrix `xml:"TileMatrix"`
+}
+
+type wmtsTileMatrix struct {
+	Identifier       string  `xml:"ows:Identifier"`
+	ScaleDenominator float64 `xml:"ScaleDenominator"`
+	TopLeftCorner    string  `xml:"TopLeftCorner"`
+	TileWidth        int     `xml:"TileWidth"`
+	TileHeight       int     `xml:"TileHeight"`
+	MatrixWidth      int     `xml:"MatrixWidth"`
+	MatrixHeight     int     `xml:"MatrixHeight"`
+}
+
+// baseURL is the absolute URL of the base path, using the token prefix when
+// one is set.
+func (m *Map) baseURL(req *http.Request) string {
+	prefix := ""
+	m.db.View(func(tx *bbolt.Tx) error {
+		if config := tx.Bucket([]byte("config")); config != nil {
+			prefix = string(config.Get([]byte("prefix")))
+		}
+		return nil
+	})
+	if prefix == "" {
+		scheme := "http"
+		if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		prefix = scheme + "://" + req.Host
+	}
+	return strings.TrimSuffix(prefix, "/") + m.cfg.BasePath
+}
+
+// mapExtent is the area of a map covered by its most zoomed out tiles, in
+// tile coords of that level.
+type mapExtent struct {
+	ID                     int
+	Name                   string
+	MinX, MinY, MaxX, MaxY int
+}
+
+// mapExtents returns the extents of the visible maps, ordered by ID.
+func (m *Map) mapExtents() []*mapExtent {
+	top := m.cfg.ZoomLevels
+	extents := map[int]*mapExtent{}
+	m.db.View(func(tx *bbolt.Tx) error {
+		maps := tx.Bucket([]byte("maps"))
+		tiles := tx.Bucket([]byte("tiles"))
+		if maps == nil || tiles == nil {
+			return nil
+		}
+		return maps.ForEach(func(k, v []byte) error {
+			mapid, err := strconv.Atoi(string(k))
+			if err != nil {
+				return nil
+			}
+			mi := MapInfo{}
+			json.Unmarshal(v, &mi)
+			if mi.Hidden {
+				return nil
+			}
+			mapb := tiles.Bucket(k)
+			if mapb == nil {
+				return nil
+			}
+			zoom := mapb.Bucket([]byte(strconv.Itoa(top)))
+			if zoom == nil {
+				return nil
+			}
+			return zoom.ForEach(func(tk, tv []byte) error {
+				td := TileData{}
+				json.Unmarshal(tv, &td)
+				e := extents[mapid]
+				if e == nil {
+					e = &mapExtent{ID: mapid, Name: mi.Name, MinX: td.Coord.X, MinY: td.Coord.Y, MaxX: td.Coord.X, MaxY: td.Coord.Y}
+					extents[mapid] = e
+				}
+				e.MinX = min(e.MinX, td.Coord.X)
+				e.MinY = min(e.MinY, td.Coord.Y)
+				e.MaxX = max(e.MaxX, td.Coord.X)
+				e.MaxY = max(e.MaxY, td.Coord.Y)
+				return nil
+			})
+		})
+	})
+	sorted := []*mapExtent{}
+	for _, e := range extents {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// origin is the grid at the top left corner of the extent, which the API
+// tile URLs count from.
+func (m *Map) origin(e *mapExtent) string {
+	return fmt.Sprintf("%d_%d", e.MinX<<m.cfg.ZoomLevels, e.MinY<<m.cfg.ZoomLevels)
+}
+
+// wmtsCRS is a plain cartesian plane in metres, which is what the map is:
+// one metre is one game unit, with y pointing up. It is GeoServer's wildcard
+// CRS, as no registry has one for a made up world.
+const wmtsCRS = "urn:ogc:def:crs:EPSG::404000"
+
+// wmtsCapabilities describes every visible map as a WMTS layer.
+func (m *Map) wmtsCapabilities(rw http.ResponseWriter, req *http.Request) {
+	if !m.apiAuths(req).Has(AUTH_MAP) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	top := m.cfg.ZoomLevels
+
+	caps := wmtsCapabilities{
+		Xmlns:       "http://www.opengis.net/wmts/1.0",
+		XmlnsOWS:    "http://www.opengis.net/ows/1.1",
+		Version:     "1.0.0",
+		Title:       m.getPage(req).Title,
+		ServiceType: "OGC WMTS",
+		TypeVersion: "1.0.0",
+	}
+	base := m.baseURL(req)
+	key := url.QueryEscape(req.URL.Query().Get("key"))
+	for _, e := range m.mapExtents() {
+		id := fmt.Sprintf("map-%d", e.ID)
+		ox, oy := e.MinX<<top, e.MinY<<top
+
+		layer := wmtsLayer{
+			Title:         e.Name,
+			Identifier:    id,
+			Style:         "default",
+			Format:        "image/png",
+			TileMatrixSet: id,
+		}
+		if layer.Title == "" {
+			layer.Title = fmt.Sprintf("Map %d", e.ID)
+		}
+		layer.ResourceURL.Format = "image/png"
+		layer.ResourceURL.ResourceType = "tile"
+		layer.ResourceURL.Template = fmt.Sprintf("%smap/wmts/%d/%s/{TileMatrix}/{TileRow}/{TileCol}.png", base, e.ID, m.origin(e))
+		if key != "" {
+			layer.ResourceURL.Template += "?key=" + key
+		}
+		caps.Layers = append(caps.Layers, layer)
+
+		set := wmtsTileMatrixSet{
+			Identifier:   id,
+			SupportedCRS: wmtsCRS,
+		}
+		for matrix := 0; matrix <= top; matrix++ {
+			z := top - matrix
+			set.TileMatrices = append(set.TileMatrices, wmtsTileMatrix{
+				Identifier: strconv.Itoa(matrix),
+				// A pixel covers 2^z game units, WMTS assumes 0.28mm pixels
+				ScaleDenominator: float64(int(1)<<z) / 0.00028,
+				TopLeftCorner:    fmt.Sprintf("%d %d", ox*tileSize, -oy*tileSize),
+				TileWidth:        tileSize,
+				TileHeight:       tileSize,
+				MatrixWidth:      (e.MaxX - e.MinX + 1) << matrix,
+				MatrixHeight:     (e.MaxY - e.MinY + 1) << matrix,
+			})
+		}
+		caps.TileMatrixSets = append(caps.TileMatrixSets, set)
+	}
+
+	rw.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(rw, xml.Header)
+	enc := xml.NewEncoder(rw)
+	enc.Indent("", "  ")
+	err := enc.Encode(caps)
+	if err != nil {
+		logger(req).Error("Error encoding WMTS capabilities", "error", err)
+	}
+}
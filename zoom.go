@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+// tileSize is the size of grid images uploaded by clients, every zoom tile
+// is built at the same size. It isn't configurable: a grid is 100 game units
+// a side, and positions, markers, the XYZ and WMTS coordinates and the
+// frontend all rely on one pixel per unit at zoom 0. It is sent to the
+// frontend with the zoom levels so the two can't disagree.
+const tileSize = 100
+
+// Zoom tiles are regenerated in the background. Requests are kept in the
+// zoomqueue bucket, keyed by zoom level first so lower levels are built
+// before the tiles made from them, and by map and coord so repeated requests
+// for the same tile are coalesced. Each request carries a sequence number;
+// a worker only removes the request it built, so a tile queued again while
+// being built is built once more.
+type zoomJob struct {
+	Map   int   `json:"map"`
+	Coord Coord `json:"coord"`
+	Zoom  int   `json:"zoom"`
+	Seq   uint64
+}
+
+func (j zoomJob) key() []byte {
+	return []byte(fmt.Sprintf("%02d/%d/%s", j.Zoom, j.Map, j.Coord.Name()))
+}
+
+type zoomQueue struct {
+	wake chan struct{}
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func newZoomQueue() *zoomQueue {
+	return &zoomQueue{
+		wake: make(chan struct{}, 1),
+		busy: map[string]bool{},
+	}
+}
+
+func (q *zoomQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+type zoomproc struct {
+	c Coord
+	m int
+}
+
+func queueZoom(tx *bbolt.Tx, mapid int, c Coord, z int) error {
+	queue, err := tx.CreateBucketIfNotExists([]byte("zoomqueue"))
+	if err != nil {
+		return err
+	}
+	j := zoomJob{Map: mapid, Coord: c, Zoom: z}
+	j.Seq, err = queue.NextSequence()
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return queue.Put(j.key(), raw)
+}
+
+// updateZooms queues the given zoom 1 tiles, the levels above follow as far
+// as their images change.
+func (m *Map) updateZooms(needProcess map[zoomproc]struct{}) {
+	if len(needProcess) == 0 {
+		return
+	}
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		for p := range needProcess {
+			err := queueZoom(tx, p.m, p.c, 1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error queueing zoom tiles", "error", err)
+		return
+	}
+	m.zooms.notify()
+}
+
+// updateZoom queues the zoom 1 tile above a grid.
+func (m *Map) updateZoom(mapid int, c Coord) {
+	m.updateZooms(map[zoomproc]struct{}{{c.Parent(), mapid}: {}})
+}
+
+func (m *Map) zoomQueueDepth() int {
+	n := 0
+	m.db.View(func(tx *bbolt.Tx) error {
+		if queue := tx.Bucket([]byte("zoomqueue")); queue != nil {
+			n = queue.Stats().KeyN
+		}
+		return nil
+	})
+	return n
+}
+
+// nextZoomJob claims the first queued tile no other worker is building.
+func (m *Map) nextZoomJob() (zoomJob, bool) {
+	m.zooms.mu.Lock()
+	defer m.zooms.mu.Unlock()
+	j := zoomJob{}
+	found := false
+	m.db.View(func(tx *bbolt.Tx) error {
+		queue := tx.Bucket([]byte("zoomqueue"))
+		if queue == nil {
+			return nil
+		}
+		c := queue.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if m.zooms.busy[string(k)] {
+				continue
+			}
+			if json.Unmarshal(v, &j) != nil {
+				continue
+			}
+			found = true
+			return nil
+		}
+		return nil
+	})
+	if found {
+		m.zooms.busy[string(j.key())] = true
+	}
+	return j, found
+}
+
+func (m *Map) finishZoomJob(j zoomJob, changed bool) {
+	err := m.db.Update(func(tx *bbolt.Tx) error {
+		queue := tx.Bucket([]byte("zoomqueue"))
+		if queue == nil || queue.Get(j.key()) == nil {
+			// Wiped while it ran
+			return nil
+		}
+		cur := zoomJob{}
+		json.Unmarshal(queue.Get(j.key()), &cur)
+		if cur.Seq == j.Seq {
+			err := queue.Delete(j.key())
+			if err != nil {
+				return err
+			}
+		}
+		if changed && j.Zoom < m.cfg.ZoomLevels {
+			return queueZoom(tx, j.Map, j.Coord.Parent(), j.Zoom+1)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error updating zoom queue", "map", j.Map, "zoom", j.Zoom, "coord", j.Coord, "error", err)
+	}
+	m.zooms.mu.Lock()
+	delete(m.zooms.busy, string(j.key()))
+	m.zooms.mu.Unlock()
+}
+
+// runZoomWorkers builds queued zoom tiles with n workers until ctx is done.
+// Tiles still queued are picked up again on the next start.
+func (m *Map) runZoomWorkers(ctx context.Context, n int) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				j, ok := m.nextZoomJob()
+				if !ok {
+					select {
+					case <-ctx.Done():
+						return
+					case <-m.zooms.wake:
+						continue
+					}
+				}
+				// Let an idle worker look for more
+				m.zooms.notify()
+				changed := m.updateZoomLevel(j.Map, j.Coord, j.Zoom)
+				m.finishZoomJob(j, changed)
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// migrateZoomLevels fits the zoom tiles to zoom_levels when it changes.
+// Levels above the new top are removed, new levels are queued to be built
+// from the old top level.
+func (m *Map) migrateZoomLevels() error {
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		config := tx.Bucket([]byte("config"))
+		prev, err := strconv.Atoi(string(config.Get([]byte("zoomLevels"))))
+		if err != nil {
+			prev = m.cfg.ZoomLevels
+			if tx.Bucket([]byte("tiles")) != nil {
+				// Maps from before zoom_levels always had 5 levels
+				prev = 5
+			}
+		}
+		if tiles := tx.Bucket([]byte("tiles")); tiles != nil && prev != m.cfg.ZoomLevels {
+			slog.Info("Changing zoom levels", "from", prev, "to", m.cfg.ZoomLevels)
+			err = tiles.ForEach(func(k, v []byte) error {
+				mapb := tiles.Bucket(k)
+				if mapb == nil {
+					return nil
+				}
+				mapid, _ := strconv.Atoi(string(k))
+				if prev < m.cfg.ZoomLevels {
+					return queueZoomLevel(tx, mapb, mapid, prev)
+				}
+				for z := m.cfg.ZoomLevels + 1; z <= prev; z++ {
+					zoom := mapb.Bucket([]byte(strconv.Itoa(z)))
+					if zoom == nil {
+						continue
+					}
+					err := zoom.ForEach(func(tk, tv []byte) error {
+						td := TileData{}
+						json.Unmarshal(tv, &td)
+						return releaseBlob(tx, td.File)
+					})
+					if err != nil {
+						return err
+					}
+					err = mapb.DeleteBucket([]byte(strconv.Itoa(z)))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if queue := tx.Bucket([]byte("zoomqueue")); queue != nil {
+			stale := [][]byte{}
+			queue.ForEach(func(k, v []byte) error {
+				j := zoomJob{}
+				json.Unmarshal(v, &j)
+				if j.Zoom > m.cfg.ZoomLevels {
+					stale = append(stale, append([]byte{}, k...))
+				}
+				return nil
+			})
+			for _, k := range stale {
+				err = queue.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return config.Put([]byte("zoomLevels"), []byte(strconv.Itoa(m.cfg.ZoomLevels)))
+	})
+}
+
+// queueZoomLevel queues the tiles above every tile of zoom level z.
+func queueZoomLevel(tx *bbolt.Tx, mapb *bbolt.Bucket, mapid int, z int) error {
+	zoom := mapb.Bucket([]byte(strconv.Itoa(z)))
+	if zoom == nil {
+		return nil
+	}
+	parents := map[Coord]struct{}{}
+	zoom.ForEach(func(k, v []byte) error {
+		td := TileData{}
+		json.Unmarshal(v, &td)
+		parents[td.Coord.Parent()] = struct{}{}
+		return nil
+	})
+	for c := range parents {
+		err := queueZoom(tx, mapid, c, z+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
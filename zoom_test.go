@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// oldZoomDB is a database from before zoom_levels: five zoom levels above
+// one grid tile and no zoomLevels key.
+func oldZoomDB(t *testing.T) *bbolt.DB {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "grids.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("config"))
+		if err != nil {
+			return err
+		}
+		tiles, err := tx.CreateBucketIfNotExists([]byte("tiles"))
+		if err != nil {
+			return err
+		}
+		mapb, err := tiles.CreateBucketIfNotExists([]byte("1"))
+		if err != nil {
+			return err
+		}
+		for z := 0; z <= 5; z++ {
+			zoom, err := mapb.CreateBucketIfNotExists([]byte(strconv.Itoa(z)))
+			if err != nil {
+				return err
+			}
+			td := TileData{MapID: 1, Zoom: z, File: "tiles/1/" + strconv.Itoa(z) + "/0_0.png"}
+			raw, _ := json.Marshal(td)
+			err = zoom.Put([]byte(td.Coord.Name()), raw)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func zoomLevelsOf(t *testing.T, db *bbolt.DB) (levels []int, saved string, queued []zoomJob) {
+	db.View(func(tx *bbolt.Tx) error {
+		tx.Bucket([]byte("tiles")).Bucket([]byte("1")).ForEach(func(k, v []byte) error {
+			z, _ := strconv.Atoi(string(k))
+			levels = append(levels, z)
+			return nil
+		})
+		saved = string(tx.Bucket([]byte("config")).Get([]byte("zoomLevels")))
+		if queue := tx.Bucket([]byte("zoomqueue")); queue != nil {
+			queue.ForEach(func(k, v []byte) error {
+				j := zoomJob{}
+				json.Unmarshal(v, &j)
+				queued = append(queued, j)
+				return nil
+			})
+		}
+		return nil
+	})
+	return levels, saved, queued
+}
+
+func TestMigrateZoomLevelsFromOldDB(t *testing.T) {
+	t.Run("fewer", func(t *testing.T) {
+		m := &Map{db: oldZoomDB(t), cfg: ServerConfig{ZoomLevels: 3}}
+		err := m.migrateZoomLevels()
+		if err != nil {
+			t.Fatal(err)
+		}
+		levels, saved, queued := zoomLevelsOf(t, m.db)
+		if len(levels) != 4 || levels[len(levels)-1] != 3 {
+			t.Errorf("levels %v left, want 0 to 3", levels)
+		}
+		if saved != "3" {
+			t.Errorf("saved zoomLevels %q, want 3", saved)
+		}
+		if len(queued) != 0 {
+			t.Errorf("queued %v", queued)
+		}
+	})
+	t.Run("more", func(t *testing.T) {
+		m := &Map{db: oldZoomDB(t), cfg: ServerConfig{ZoomLevels: 7}}
+		err := m.migrateZoomLevels()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, saved, queued := zoomLevelsOf(t, m.db)
+		if saved != "7" {
+			t.Errorf("saved zoomLevels %q, want 7", saved)
+		}
+		if len(queued) != 1 || queued[0].Zoom != 6 || queued[0].Map != 1 {
+			t.Errorf("queued %v, want level 6 of map 1", queued)
+		}
+	})
+	t.Run("same", func(t *testing.T) {
+		m := &Map{db: oldZoomDB(t), cfg: ServerConfig{ZoomLevels: 5}}
+		err := m.migrateZoomLevels()
+		if err != nil {
+			t.Fatal(err)
+		}
+		levels, saved, queued := zoomLevelsOf(t, m.db)
+		if len(levels) != 6 || saved != "5" || len(queued) != 0 {
+			t.Errorf("levels %v, saved %q, queued %v, want nothing changed", levels, saved, queued)
+		}
+	})
+}